@@ -0,0 +1,287 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"saassoft.net/signaldistribution/base"
+	"saassoft.net/signaldistribution/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiPage is a page of the items of a resource, Total is the count of all the items.
+type apiPage struct {
+	Total  int
+	Offset int
+	Limit  int
+	Items  interface{}
+}
+
+type apiError struct {
+	Error string
+}
+
+type apiChannel struct {
+	CID         string
+	ClientCount int
+}
+
+type apiClient struct {
+	UPID       string
+	PID        string
+	IP         string
+	JoinTime   time.Time
+	QueueDepth int
+	Dropped    int64
+	Expired    int64
+	Violations int64
+}
+
+type apiRelay struct {
+	UPID        string
+	RemoteSID   string
+	RemoteMode  int
+	IsRequester bool
+	QueueDepth  int
+	Dropped     int64
+	Expired     int64
+	Time        time.Time
+	Uptime      int64 // seconds
+}
+
+type apiRecorder struct {
+	UPID       string
+	RemoteSID  string
+	QueueDepth int
+	Dropped    int64
+	Expired    int64
+	Time       time.Time
+	Uptime     int64 // seconds
+}
+
+type apiCounters struct {
+	SID         string
+	Time        time.Time
+	Uptime      int64 // seconds
+	Clients     int
+	Channels    int
+	Relays      int
+	Recorders   int
+	Broadcasted int // ids of broadcasted signals kept for dropping duplicates
+	Violations  signal.Violations
+	Capacity    base.Capacity
+	Draining    bool
+}
+
+// stationAPI writes the json of the resource at the end of the path, the api is versioned by the path.
+// Resources: channels, channels/<cid>/clients, relays, recorders, and counters of the station.
+// Lists are sorted and paged by the parameters offset and limit, limit is DEFAULT_PAGE_SIZE at default and MAX_PAGE_SIZE at most.
+// The parameter token must be the admin secret, the api is disabled if the secret is not configured.
+func stationAPI(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if config.AdminSecret == "" || !hmac.Equal([]byte(req.FormValue("token")), []byte(config.AdminSecret)) {
+		writeAPIError(w, http.StatusForbidden, "bad token")
+		return
+	}
+	offset, limit, err := parsePage(req)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	resource := strings.TrimPrefix(req.URL.Path, base.STATION_API_PATH)
+	if strings.HasPrefix(resource, "channels/") && strings.HasSuffix(resource, "/clients") {
+		cid := strings.TrimSuffix(strings.TrimPrefix(resource, "channels/"), "/clients")
+		if page := apiClients(cid, offset, limit); page != nil {
+			writeAPI(w, page)
+		} else {
+			writeAPIError(w, http.StatusNotFound, "unknown channel")
+		}
+		return
+	}
+	switch resource {
+	case "channels":
+		writeAPI(w, apiChannels(offset, limit))
+	case "relays":
+		writeAPI(w, apiRelays(offset, limit))
+	case "recorders":
+		writeAPI(w, apiRecorders(offset, limit))
+	case "counters":
+		writeAPI(w, apiStationCounters())
+	default:
+		writeAPIError(w, http.StatusNotFound, "unknown resource")
+	}
+}
+
+func parsePage(req *http.Request) (int, int, error) {
+	offset, limit := 0, base.DEFAULT_PAGE_SIZE
+	var err error
+	if value := req.FormValue("offset"); value != "" {
+		if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+			return 0, 0, errors.New("bad offset")
+		}
+	}
+	if value := req.FormValue("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			return 0, 0, errors.New("bad limit")
+		}
+	}
+	if limit > base.MAX_PAGE_SIZE {
+		limit = base.MAX_PAGE_SIZE
+	}
+	return offset, limit, nil
+}
+
+// pageRange returns the range of the page in the items of the total count.
+func pageRange(total int, offset int, limit int) (int, int) {
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return offset, end
+}
+
+func apiChannels(offset int, limit int) *apiPage {
+	channels := station.Channels()
+	sort.Sort(channelsByCID(channels))
+	start, end := pageRange(len(channels), offset, limit)
+	items := []*apiChannel{}
+	for _, channel := range channels[start:end] {
+		items = append(items, &apiChannel{CID: channel.CID, ClientCount: channel.ClientCount()})
+	}
+	return &apiPage{Total: len(channels), Offset: offset, Limit: limit, Items: items}
+}
+
+// apiClients returns the page of the clients in the channel, or nil if the channel is not opened in the station.
+func apiClients(cid string, offset int, limit int) *apiPage {
+	var channel *signal.Channel
+	for _, opened := range station.Channels() {
+		if opened.CID == cid {
+			channel = opened
+		}
+	}
+	if channel == nil {
+		return nil
+	}
+	clients := channel.Clients()
+	upids := make([]string, 0, len(clients))
+	for upid, _ := range clients {
+		upids = append(upids, upid)
+	}
+	sort.Strings(upids)
+	start, end := pageRange(len(upids), offset, limit)
+	items := []*apiClient{}
+	for _, upid := range upids[start:end] {
+		client := clients[upid]
+		item := &apiClient{
+			UPID:       upid,
+			PID:        client.Info.PID,
+			IP:         client.IP(),
+			QueueDepth: client.Info.QueueDepth(),
+			Dropped:    client.Info.DroppedCount(),
+			Expired:    client.Info.ExpiredCount(),
+			Violations: client.ViolationCount(),
+		}
+		if presence := channel.Presence(upid); presence != nil {
+			item.JoinTime = presence.Time
+		}
+		items = append(items, item)
+	}
+	return &apiPage{Total: len(upids), Offset: offset, Limit: limit, Items: items}
+}
+
+func apiRelays(offset int, limit int) *apiPage {
+	relays := station.Relays()
+	sort.Sort(relaysByUPID(relays))
+	start, end := pageRange(len(relays), offset, limit)
+	items := []*apiRelay{}
+	for _, relay := range relays[start:end] {
+		items = append(items, &apiRelay{
+			UPID:        relay.Info.UPID,
+			RemoteSID:   relay.RemoteSID,
+			RemoteMode:  relay.RemoteMode,
+			IsRequester: relay.IsRequester,
+			QueueDepth:  relay.Info.QueueDepth(),
+			Dropped:     relay.Info.DroppedCount(),
+			Expired:     relay.Info.ExpiredCount(),
+			Time:        relay.Time,
+			Uptime:      int64(time.Since(relay.Time) / time.Second),
+		})
+	}
+	return &apiPage{Total: len(relays), Offset: offset, Limit: limit, Items: items}
+}
+
+func apiRecorders(offset int, limit int) *apiPage {
+	recorders := station.Recorders()
+	sort.Sort(recordersByUPID(recorders))
+	start, end := pageRange(len(recorders), offset, limit)
+	items := []*apiRecorder{}
+	for _, recorder := range recorders[start:end] {
+		items = append(items, &apiRecorder{
+			UPID:       recorder.Info.UPID,
+			RemoteSID:  recorder.RemoteSID,
+			QueueDepth: recorder.Info.QueueDepth(),
+			Dropped:    recorder.Info.DroppedCount(),
+			Expired:    recorder.Info.ExpiredCount(),
+			Time:       recorder.Time,
+			Uptime:     int64(time.Since(recorder.Time) / time.Second),
+		})
+	}
+	return &apiPage{Total: len(recorders), Offset: offset, Limit: limit, Items: items}
+}
+
+func apiStationCounters() *apiCounters {
+	return &apiCounters{
+		SID:         station.Info.SID,
+		Time:        station.Time,
+		Uptime:      int64(time.Since(station.Time) / time.Second),
+		Clients:     station.ClientCount(),
+		Channels:    station.ChannelCount(),
+		Relays:      station.RelayCount(),
+		Recorders:   len(station.Recorders()),
+		Broadcasted: station.BroadcastedCount(),
+		Violations:  station.Violations(),
+		Capacity:    station.Capacity(),
+		Draining:    station.IsDraining(),
+	}
+}
+
+func writeAPI(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, text string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&apiError{Error: text})
+}
+
+type channelsByCID []*signal.Channel
+
+func (this channelsByCID) Len() int           { return len(this) }
+func (this channelsByCID) Less(i, j int) bool { return this[i].CID < this[j].CID }
+func (this channelsByCID) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
+
+type relaysByUPID []*signal.Relay
+
+func (this relaysByUPID) Len() int           { return len(this) }
+func (this relaysByUPID) Less(i, j int) bool { return this[i].Info.UPID < this[j].Info.UPID }
+func (this relaysByUPID) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
+
+type recordersByUPID []*signal.Recorder
+
+func (this recordersByUPID) Len() int           { return len(this) }
+func (this recordersByUPID) Less(i, j int) bool { return this[i].Info.UPID < this[j].Info.UPID }
+func (this recordersByUPID) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
@@ -0,0 +1,140 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package main
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"saassoft.net/signaldistribution/base"
+	"saassoft.net/signaldistribution/signal"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startAPIStation starts the station of the api with the clients joined in the channels, pids are keyed by cid.
+func startAPIStation(t *testing.T, pids map[string][]string) (*httptest.Server, []*websocket.Conn) {
+	log.SetOutput(ioutil.Discard)
+	config = &Config{AdminSecret: "secret"}
+	station = &signal.Station{}
+	server := httptest.NewServer(websocket.Handler(station.ClientJoin))
+	station.InitWith(&base.ServerInfo{SID: "s1", IP: "127.0.0.1", Port: 1, Mode: base.STATION_MODE_TRUNK}, nil)
+	conns := []*websocket.Conn{}
+	for cid, list := range pids {
+		for _, pid := range list {
+			query := url.Values{"cid": {cid}, "token": {pid}}
+			ws, err := websocket.Dial("ws://"+server.Listener.Addr().String()+"/?"+query.Encode(), "", "http://localhost/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conns = append(conns, ws)
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for {
+				var received signal.Signal
+				if err := signal.JSONCodec.Receive(ws, &received); err != nil {
+					t.Fatal("not joined:", err)
+				}
+				if received.Type == base.SIGNALTYPE_PJOIN && strings.HasPrefix(received.PID, pid+"_") {
+					break
+				}
+			}
+		}
+	}
+	return server, conns
+}
+
+// getAPI gets the resource of the api with the query, and decodes the json into v.
+func getAPI(t *testing.T, resource string, query string, v interface{}) int {
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", base.STATION_API_PATH+resource+"?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stationAPI(recorder, req)
+	if v != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), v); err != nil {
+			t.Fatal("bad json:", recorder.Body.String())
+		}
+	}
+	return recorder.Code
+}
+
+// TestAPIPagesChannelsAndClients lists the channels and the clients of a channel page by page.
+func TestAPIPagesChannelsAndClients(t *testing.T) {
+	server, conns := startAPIStation(t, map[string][]string{"a": {"p1"}, "b": {"p2", "p3", "p4"}, "c": {"p5"}})
+	defer server.Close()
+	defer station.Close()
+	for _, ws := range conns {
+		defer ws.Close()
+	}
+
+	var channels struct {
+		Total int
+		Items []apiChannel
+	}
+	getAPI(t, "channels", "token=secret&limit=2", &channels)
+	if channels.Total != 3 || len(channels.Items) != 2 || channels.Items[0].CID != "a" || channels.Items[1].CID != "b" {
+		t.Fatal("first page of channels:", channels)
+	}
+	if channels.Items[1].ClientCount != 3 {
+		t.Fatal("client count of b:", channels.Items[1].ClientCount)
+	}
+	getAPI(t, "channels", "token=secret&limit=2&offset=2", &channels)
+	if channels.Total != 3 || len(channels.Items) != 1 || channels.Items[0].CID != "c" {
+		t.Fatal("second page of channels:", channels)
+	}
+
+	var clients struct {
+		Total int
+		Items []apiClient
+	}
+	getAPI(t, "channels/b/clients", "token=secret&offset=1&limit=1", &clients)
+	if clients.Total != 3 || len(clients.Items) != 1 || clients.Items[0].PID != "p3" {
+		t.Fatal("page of clients:", clients)
+	}
+
+	var counters apiCounters
+	getAPI(t, "counters", "token=secret", &counters)
+	if counters.SID != "s1" || counters.Clients != 5 || counters.Channels != 3 {
+		t.Fatal("counters:", counters)
+	}
+}
+
+// TestAPIRejectsBadRequests requests the api without the secret, with bad parameters and unknown resources.
+func TestAPIRejectsBadRequests(t *testing.T) {
+	server, conns := startAPIStation(t, nil)
+	defer server.Close()
+	defer station.Close()
+	for _, ws := range conns {
+		defer ws.Close()
+	}
+
+	cases := []struct {
+		resource string
+		query    string
+		status   int
+	}{
+		{"channels", "", http.StatusForbidden},
+		{"channels", "token=other", http.StatusForbidden},
+		{"channels", "token=secret&limit=0", http.StatusBadRequest},
+		{"channels", "token=secret&offset=-1", http.StatusBadRequest},
+		{"channels/none/clients", "token=secret", http.StatusNotFound},
+		{"none", "token=secret", http.StatusNotFound},
+		{"channels", "token=secret", http.StatusOK},
+	}
+	for _, c := range cases {
+		var apiErr apiError
+		if status := getAPI(t, c.resource, c.query, &apiErr); status != c.status {
+			t.Error(c.resource, c.query, "status:", status, apiErr.Error)
+		}
+	}
+	config.AdminSecret = ""
+	if status := getAPI(t, "channels", "token=", nil); status != http.StatusForbidden {
+		t.Fatal("api without the secret configured:", status)
+	}
+}
@@ -5,8 +5,8 @@ package base
 
 import (
 	"code.google.com/p/go.net/websocket"
+	"errors"
 	"fmt"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -14,12 +14,80 @@ import (
 
 // Signal types.
 const (
-	SIGNALTYPE_BLANK  = iota // blank signal
-	SIGNALTYPE_SIGNAL        // text signal
-	SIGNALTYPE_PJOIN         // participant join signal
-	SIGNALTYPE_PQUIT         // participant quit signal
-	SIGNALTYPE_CMD           // command signal
-	SIGNALTYPE_ERROR         // error singal
+	SIGNALTYPE_BLANK    = iota // blank signal
+	SIGNALTYPE_SIGNAL          // text signal
+	SIGNALTYPE_PJOIN           // participant join signal
+	SIGNALTYPE_PQUIT           // participant quit signal
+	SIGNALTYPE_CMD             // command signal
+	SIGNALTYPE_ERROR           // error singal
+	SIGNALTYPE_PRESENCE        // presence signal, text is the json of participants in the channel
+	SIGNALTYPE_ACK             // station acknowledges a signal published by a reliable client, text is the id of the signal
+	SIGNALTYPE_REQUEST         // request signal, it waits for a reply signal with the same correlation id
+	SIGNALTYPE_REPLY           // reply signal, it is sent to the reply-to of the request
+	SIGNALTYPE_REDIRECT        // station is shutting down, client should reconnect to another station routed by the route server
+	SIGNALTYPE_STATE           // state signal, text is the json of changed entries of the channel state, or the snapshot for a joining client
+)
+
+// Error texts of error signals those clients may handle.
+const (
+	ERROR_GAP     = "gap"     // signals since the resume point are not available
+	ERROR_TIMEOUT = "timeout" // no reply for the request in time, the error signal carries the correlation id of the request
+
+	ERROR_CLIENTLIMIT    = "client rate limit"  // client publishes too many signals or bytes
+	ERROR_CHANNELLIMIT   = "channel rate limit" // channel receives too many signals or bytes
+	ERROR_STATIONLIMIT   = "station rate limit" // station receives too many signals or bytes
+	ERROR_SIGNALTOOLARGE = "signal too large"   // signal is larger than the bytes per second of a rate limit, it never passes
+	ERROR_SHUTTINGDOWN   = "shutting down"      // station is shutting down and does not accept joins
+	ERROR_STATIONFULL    = "station full"       // station has the max count of clients
+	ERROR_CHANNELFULL    = "channel full"       // channel has the max count of clients
+	ERROR_MAXCHANNELS    = "too many channels"  // station has the max count of channels and can not open a new one
+
+	ERROR_KICKED = "kicked" // client is disconnected from the channel by the admin
+	ERROR_BANNED = "banned" // client is banned from the channel by the admin
+	ERROR_MUTED  = "muted"  // client is muted in the channel by the admin, its signals are dropped
+)
+
+// Admin actions on the participants, see Moderation.
+const (
+	MODERATION_KICK   = "kick"
+	MODERATION_BAN    = "ban"
+	MODERATION_MUTE   = "mute"
+	MODERATION_UNBAN  = "unban"
+	MODERATION_UNMUTE = "unmute"
+)
+
+// System headers of signals. They are set by the station that receives the signal from the client,
+// the headers with the system prefix set by clients are removed.
+const (
+	HEADER_SYSTEM_PREFIX = "sys-"
+	HEADER_ORIGIN_SID    = "sys-origin-sid"   // sid of the station that received the signal from the client
+	HEADER_RECEIVE_TIME  = "sys-receive-time" // time the signal was received, formatted in RFC3339 with nanoseconds
+)
+
+// Station events notified to webhooks.
+const (
+	EVENT_CHANNELOPEN   = "channel.open"  // id is the cid
+	EVENT_CHANNELCLOSE  = "channel.close" // id is the cid
+	EVENT_CLIENTJOIN    = "client.join"   // id is the upid, pid is the pid of the client
+	EVENT_CLIENTQUIT    = "client.quit"   // id is the upid, pid is the pid of the client
+	EVENT_RELAYUP       = "relay.up"      // id is the upid of the relay
+	EVENT_RELAYDOWN     = "relay.down"    // id is the upid of the relay
+	EVENT_RECORDERUP    = "recorder.up"   // id is the upid of the recorder
+	EVENT_RECORDERDOWN  = "recorder.down" // id is the upid of the recorder
+	WEBHOOK_SIGNATURE   = "X-Signature"   // header of webhook request, hex of HMAC-SHA256 of the body signed by the secret
+	WEBHOOK_EVENT       = "X-Event"       // header of webhook request, type of the event
+	WEBHOOK_MAX_RETRIES = 5               // times of retrying a webhook request that failed
+)
+
+// Client commands. A client sends a command signal with text formed as "command:argument".
+const (
+	CLIENTCMD_SUBSCRIBE       = "subscribe"       // client joins in the channel, argument is cid or channel pattern
+	CLIENTCMD_UNSUBSCRIBE     = "unsubscribe"     // client quits from the channel, argument is cid or channel pattern
+	CLIENTCMD_PRESENCE        = "presence"        // client queries participants in the channel of the station, argument is cid
+	CLIENTCMD_CLUSTERPRESENCE = "clusterpresence" // client queries participants in the channel of the cluster, argument is cid
+	CLIENTCMD_ACK             = "ack"             // reliable client acknowledges signals, argument is signal ids separated by ","
+	CLIENTCMD_SET             = "set"             // client sets a key of the channel state, argument is "<cid>:<key>=<value>", empty cid is the joined channel
+	CLIENTCMD_DELETE          = "delete"          // client deletes a key of the channel state, argument is "<cid>:<key>"
 )
 
 // Service Mode. It can be multiplicity.
@@ -36,6 +104,21 @@ const (
 	STATION_MODE_LEAF               // station run as leaf node
 )
 
+// Permissions of a participant on a channel. They can be multiplicity.
+const (
+	PERMISSION_PUBLISH   = 1 << iota // participant can broadcast signals to the channel
+	PERMISSION_SUBSCRIBE             // participant can receive signals from the channel
+)
+
+// Overflow policies of participant's signal queue, when the queue is full:
+// the channel pushes to its participants one by one, so only OVERFLOW_BLOCK lets a slow participant stall the channel.
+const (
+	OVERFLOW_BLOCK      = iota // pusher waits until the queue has room
+	OVERFLOW_DROPOLDEST        // the oldest signal in the queue is dropped, it is the default of the config
+	OVERFLOW_DROPNEWEST        // the pushed signal is dropped
+	OVERFLOW_DISCONNECT        // pusher waits for the timeout, then the participant is disconnected
+)
+
 // Route command types;
 const (
 	ROUTECMDTYPE_BLANK            = iota // blank command
@@ -65,6 +148,18 @@ const (
 	ROUTECMDTYPE_RECORDERQUITECHO        //
 	ROUTECMDTYPE_REPORTRELAY             //
 	ROUTECMDTYPE_REPORTRELAYECHO         //
+	ROUTECMDTYPE_CHANNELS                // station reports all clients in channels
+	ROUTECMDTYPE_CHANNELSECHO            //
+	ROUTECMDTYPE_CHANNELJOIN             // station reports one client joined in a channel
+	ROUTECMDTYPE_CHANNELJOINECHO         //
+	ROUTECMDTYPE_CHANNELQUIT             // station reports one client quitted from a channel
+	ROUTECMDTYPE_CHANNELQUITECHO         //
+	ROUTECMDTYPE_STATIONQUIT             // station reports it is shutting down
+	ROUTECMDTYPE_STATIONQUITECHO         //
+	ROUTECMDTYPE_CAPACITY                // station reports its capacity
+	ROUTECMDTYPE_CAPACITYECHO            //
+	ROUTECMDTYPE_MODERATION              // station reports an admin action, route server orders it to other stations
+	ROUTECMDTYPE_MODERATIONECHO          //
 )
 
 // default value defines.
@@ -72,12 +167,37 @@ const (
 	DEFAULT_SERVICE_PORT = 25152
 	DEFAULT_SERVICE_MODE = SERVICE_MODE_STATION
 	DEFAULT_STATION_MODE = STATION_MODE_TRUNK
+	DEFAULT_QUEUE_SIZE   = 100  // size of participant's signal queue
+	ROUTE_QUEUE_SIZE     = 1000 // size of the queue of changes reported to a route server
+	DEFAULT_HISTORY_SIZE = 1000 // count of latest signals kept for each channel
+	DEFAULT_MAX_UNACKED  = 1000 // count of signals kept unacked for each reliable client
+	DEFAULT_PAGE_SIZE    = 100  // count of items in a page of the station api
+	MAX_PAGE_SIZE        = 1000 // max count of items in a page of the station api
+
+	MAX_RETAINED_SIZE    = 65536 // max bytes of the text and the payload of a retained signal
+	MAX_STATE_KEYS       = 1000  // max count of keys in the state of a channel, deleted keys excluded
+	MAX_STATE_ENTRY_SIZE = 65536 // max bytes of the key and the value of a state entry
+
+	DEFAULT_REQUEST_TIMEOUT  = 10 * time.Second // time of station waits for the reply of a request
+	DEFAULT_SHUTDOWN_TIMEOUT = 10 * time.Second // time of station waits for the queues to be flushed when shutting down
 
 	ROUTE_SERVER_CHECKRELAYS_INTERVAL          = 5 * time.Second // interval of route server checks relays of stations connected are in expected state.
 	STATION_TRY_RECONNECT_ROUTESERVER_INTERVAL = 5 * time.Second // interval of station tries to reconnect route server when it disconnected from route server.
 	STATION_TRY_RECONNECT_RECORDER_INTERVAL    = 5 * time.Second // interval of station tries to reconnect recorder when it disconnected from recorder.
 
 	STATION_BROADCASTED_CACHE_TIMEOUT = 30 * time.Second
+	STATION_QUERY_PRESENCE_TIMEOUT    = 3 * time.Second // timeout of station queries the cluster presence from route server.
+	STATION_HISTORY_TIMEOUT           = 5 * time.Minute // time of station keeps the history of a closed channel.
+	STATION_ACK_TIMEOUT               = 5 * time.Second // time of station waits for the ack of a signal before redelivering it.
+	STATION_UNACKED_TIMEOUT           = 5 * time.Minute // time of station keeps unacked signals of a quitted client, and ids published by reliable clients.
+	RECORDER_PURGE_INTERVAL           = time.Minute     // interval of recorder purges expired signals.
+	STATION_REPORT_CAPACITY_INTERVAL  = 5 * time.Second // interval of station reports its capacity to route server.
+	STATION_RETAINED_INTERVAL         = time.Minute     // interval of station removes the expired retained signals.
+	STATION_TOMBSTONE_TIMEOUT         = 5 * time.Minute // time of station keeps a deleted key of a channel state.
+
+	STATION_DRAIN_INTERVAL = 100 * time.Millisecond // interval of station checks the queues are flushed when shutting down.
+	WEBHOOK_TIMEOUT        = 5 * time.Second        // timeout of a webhook request.
+	WEBHOOK_RETRY_INTERVAL = time.Second            // interval of retrying a failed webhook request, it doubles after each retry.
 
 	WEBSOCKET_PREFIX           = "ws://"                  // websocket schema
 	STATION_CLIENT_JOIN_PATH   = "/station/client/join"   // path for client to join to station
@@ -85,9 +205,13 @@ const (
 	RECORDER_FETCH_PATH        = "/recorder/fetch"        // path for fetching history signals from recorder
 	RECORDER_STATION_JOIN_PATH = "/recorder/station/join" // path for station to join to recorder
 	STATION_STATISTICS_PATH    = "/station/stat"          // path for statistics of station
+	STATION_PRESENCE_PATH      = "/station/presence"      // path for querying participants in a channel
+	STATION_ADMIN_PATH         = "/station/admin/"        // path for admin actions on participants, followed by the action
+	STATION_API_PATH           = "/station/api/v1/"       // path for the json api of station, followed by the resource
 	ROUTE_REGISTER_PATH        = "/route/register"        // path for station to registering to route.
 	ROUTE_STATISTICS_PATH      = "/route/stat"            // path for statistics of route
 	ROUTE_ROUTE_PATH           = "/route/route"           // path for client to route
+	ROUTE_PRESENCE_PATH        = "/route/presence"        // path for station to query participants in a channel of the cluster
 	ROUTE_REALTIME_PATH        = "/route/realtime"        // path for realtime viewer to connect
 	SERVICE_HTML_DIR           = "./html/"                // local path of html files
 )
@@ -101,6 +225,12 @@ type ServiceMode int
 // StationMode is mode of station,see constants named start with "STATION_MODE_".
 type StationMode int
 
+// Permission is permission of participant,see constants named start with "PERMISSION_".
+type Permission int
+
+// OverflowPolicy is overflow policy of signal queue,see constants named start with "OVERFLOW_".
+type OverflowPolicy int
+
 // RouteCmdType is type of route command,see constants named start with "ROUTECMDTYPE_".
 type RouteCmdType int
 
@@ -111,11 +241,13 @@ type RemoteInfo struct {
 }
 
 // ServerInfo represents a server's information.
+// Binary is true if the server receives signals in binary frames, it is false from the servers of older versions.
 type ServerInfo struct {
-	SID  string
-	IP   string
-	Port int
-	Mode int
+	SID    string
+	IP     string
+	Port   int
+	Mode   int
+	Binary bool
 }
 
 // Addr retruns server's ip address.
@@ -123,12 +255,189 @@ func (this *ServerInfo) Addr() string {
 	return this.IP + ":" + strconv.Itoa(this.Port)
 }
 
+// QueuePolicy represents the size and the overflow policy of participant's signal queue.
+type QueuePolicy struct {
+	Size     int
+	Overflow OverflowPolicy
+	Timeout  time.Duration // timeout of OVERFLOW_DISCONNECT
+}
+
+// ParseQueuePolicy parses the overflow policy from text,
+// text is one of "block", "dropoldest", "dropnewest" and "disconnect:<timeout ms>", empty text means "dropoldest".
+func ParseQueuePolicy(text string, size int) (QueuePolicy, error) {
+	policy := QueuePolicy{Size: size}
+	if policy.Size <= 0 {
+		policy.Size = DEFAULT_QUEUE_SIZE
+	}
+	switch {
+	case text == "block":
+		policy.Overflow = OVERFLOW_BLOCK
+	case text == "" || text == "dropoldest":
+		policy.Overflow = OVERFLOW_DROPOLDEST
+	case text == "dropnewest":
+		policy.Overflow = OVERFLOW_DROPNEWEST
+	case strings.HasPrefix(text, "disconnect:"):
+		ms, err := strconv.Atoi(text[len("disconnect:"):])
+		if err != nil || ms <= 0 {
+			return policy, errors.New("invalid overflow policy: " + text)
+		}
+		policy.Overflow = OVERFLOW_DISCONNECT
+		policy.Timeout = time.Duration(ms) * time.Millisecond
+	default:
+		return policy, errors.New("invalid overflow policy: " + text)
+	}
+	return policy, nil
+}
+
+// HeartbeatPolicy represents the heartbeat of a websocket link.
+// Each side sends a blank signal or a blank route command every Interval,
+// and the link is closed when nothing is received from the remote in Timeout, zero value means disabled.
+type HeartbeatPolicy struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// SetReadDeadline sets the read deadline of the connection for the next receiving.
+func (this HeartbeatPolicy) SetReadDeadline(ws *websocket.Conn) {
+	if this.Timeout > 0 {
+		ws.SetReadDeadline(time.Now().Add(this.Timeout))
+	}
+}
+
+// Run calls beat every interval until stop is closed or beat fails.
+func (this HeartbeatPolicy) Run(stop chan bool, beat func() error) {
+	if this.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(this.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := beat(); err != nil {
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Event represents a lifecycle event of the station.
+type Event struct {
+	Type string
+	SID  string // sid of the station
+	ID   string
+	PID  string
+	Time time.Time
+}
+
+// RateLimit represents the rate of signals and bytes per second, zero value means no limit.
+// The limit is applied as a token bucket, the burst is the rate of one second.
+type RateLimit struct {
+	Signals int // signals per second
+	Bytes   int // bytes of text and payload per second
+}
+
+// ParseRateLimit parses the rate limit from text formed as "<signals>,<bytes>", empty text means no limit.
+func ParseRateLimit(text string) (RateLimit, error) {
+	limit := RateLimit{}
+	if text == "" {
+		return limit, nil
+	}
+	parts := strings.Split(text, ",")
+	if len(parts) != 2 {
+		return limit, errors.New("invalid rate limit: " + text)
+	}
+	var err1, err2 error
+	limit.Signals, err1 = strconv.Atoi(strings.TrimSpace(parts[0]))
+	limit.Bytes, err2 = strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err1 != nil || err2 != nil || limit.Signals < 0 || limit.Bytes < 0 {
+		return RateLimit{}, errors.New("invalid rate limit: " + text)
+	}
+	return limit, nil
+}
+
+// Capacity represents the count of clients and channels of a station and the limits of them, zero limit means no limit.
+type Capacity struct {
+	Clients     int
+	MaxClients  int
+	Channels    int
+	MaxChannels int
+}
+
+// RemainingClients returns the count of clients the station can accept more, -1 means no limit.
+func (this *Capacity) RemainingClients() int {
+	if this.MaxClients <= 0 {
+		return -1
+	}
+	if this.Clients >= this.MaxClients {
+		return 0
+	}
+	return this.MaxClients - this.Clients
+}
+
+// IsFull returns true if the station can not accept more clients, or can not open more channels.
+func (this *Capacity) IsFull() bool {
+	return this.RemainingClients() == 0 || this.MaxChannels > 0 && this.Channels >= this.MaxChannels
+}
+
+// Moderation represents an admin action on the participants in a channel, empty CID means every channel.
+// Kick disconnects the participants with the upid or pid ID from the channel.
+// Ban rejects the participants with the pid ID or the ip IP from joining in the channel, and kicks those in it.
+// Mute drops the signals published to the channel by the participants with the upid or pid ID.
+// Bans and mutes last until Expires, zero value means forever, unban and unmute lift those with the same CID, ID and IP.
+type Moderation struct {
+	Action  string
+	CID     string
+	ID      string // upid or pid
+	IP      string
+	Expires time.Time
+}
+
+// Key returns the key of the ban or the mute that the moderation sets or lifts.
+func (this *Moderation) Key() string {
+	kind := this.Action
+	switch kind {
+	case MODERATION_UNBAN:
+		kind = MODERATION_BAN
+	case MODERATION_UNMUTE:
+		kind = MODERATION_MUTE
+	}
+	return kind + "|" + this.CID + "|" + this.ID + "|" + this.IP
+}
+
+// IsExpired returns true if the ban or the mute has been expired.
+func (this *Moderation) IsExpired() bool {
+	return !this.Expires.IsZero() && time.Now().After(this.Expires)
+}
+
+// Matches returns true if the moderation applies to the participant in the channel.
+func (this *Moderation) Matches(cid string, upid string, pid string, ip string) bool {
+	if this.CID != "" && this.CID != cid {
+		return false
+	}
+	if this.ID != "" && (this.ID == upid || this.ID == pid) {
+		return true
+	}
+	return this.IP != "" && this.IP == ip
+}
+
 // RouteCmd represents a route command.
 type RouteCmd struct {
 	Type RouteCmdType
 	Text string // command text
 }
 
+// Presence represents a participant presents in a channel.
+type Presence struct {
+	CID  string
+	PID  string
+	UPID string
+	SID  string    // sid of the station the participant connected to
+	Time time.Time // time of the participant joined in the channel
+}
+
 type MyLogger struct {
 }
 
@@ -148,6 +457,50 @@ func StringInArray(str string, array []string) bool {
 	return false
 }
 
+// MatchChannel returns true if the channel id matches the pattern.
+// Channel ids are dotted hierarchies, e.g. "site1.floor2.sensor7".
+// In the pattern, "*" matches exactly one level, ">" as the last level matches one or more levels,
+// e.g. "site1.*.sensor7" and "site1.>" both match "site1.floor2.sensor7".
+func MatchChannel(pattern string, cid string) bool {
+	pTokens := strings.Split(pattern, ".")
+	cTokens := strings.Split(cid, ".")
+	for i, token := range pTokens {
+		if token == ">" && i == len(pTokens)-1 {
+			return len(cTokens) > i
+		}
+		if i >= len(cTokens) || token != "*" && token != cTokens[i] {
+			return false
+		}
+	}
+	return len(pTokens) == len(cTokens)
+}
+
+// CoversPattern returns true if every channel id matched by the pattern is matched by the grant pattern too,
+// e.g. "site1.>" covers "site1.*.sensor7", but "site1.*" does not cover "site1.>".
+func CoversPattern(grant string, pattern string) bool {
+	gTokens := strings.Split(grant, ".")
+	pTokens := strings.Split(pattern, ".")
+	for i, token := range gTokens {
+		if token == ">" && i == len(gTokens)-1 {
+			return len(pTokens) > i
+		}
+		if i >= len(pTokens) || pTokens[i] == ">" || token != "*" && token != pTokens[i] {
+			return false
+		}
+	}
+	return len(gTokens) == len(pTokens)
+}
+
+// IsChannelPattern returns true if the channel id contains wildcard levels.
+func IsChannelPattern(cid string) bool {
+	for _, token := range strings.Split(cid, ".") {
+		if token == "*" || token == ">" {
+			return true
+		}
+	}
+	return false
+}
+
 // SubString returns the substring from begin point with length in str.
 func SubString(str string, begin int, length int) (substr string) {
 	rs := []rune(str)
@@ -0,0 +1,70 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package base
+
+import (
+	"testing"
+)
+
+func TestMatchChannel(t *testing.T) {
+	cases := []struct {
+		pattern string
+		cid     string
+		match   bool
+	}{
+		{"site1.floor2.sensor7", "site1.floor2.sensor7", true},
+		{"site1.floor2", "site1.floor2.sensor7", false},
+		{"site1.*.sensor7", "site1.floor2.sensor7", true},
+		{"site1.*.sensor7", "site1.floor2.sensor8", false},
+		{"site1.*", "site1.floor2.sensor7", false},
+		{"site1.>", "site1.floor2.sensor7", true},
+		{"site1.>", "site1.floor2", true},
+		{"site1.>", "site1", false},
+		{">", "site1", true},
+		{"*", "site1", true},
+		{"*", "site1.floor2", false},
+		{"site1.>.sensor7", "site1.floor2.sensor7", false},
+	}
+	for _, c := range cases {
+		if MatchChannel(c.pattern, c.cid) != c.match {
+			t.Error("MatchChannel", c.pattern, c.cid, "is not", c.match)
+		}
+	}
+}
+
+func TestCoversPattern(t *testing.T) {
+	cases := []struct {
+		grant   string
+		pattern string
+		covers  bool
+	}{
+		{"site1.>", "site1.*.sensor7", true},
+		{"site1.>", "site1.>", true},
+		{"site1.>", "site1.floor2.>", true},
+		{">", "*.>", true},
+		{"site1.*", "site1.*", true},
+		{"site1.*", "site1.>", false},
+		{"site1.*.sensor7", "site1.*.*", false},
+		{"site1.floor2.*", "site1.*.sensor7", false},
+		{"site1.>", "site2.>", false},
+		{"site1.*", "site1.floor2", true},
+	}
+	for _, c := range cases {
+		if CoversPattern(c.grant, c.pattern) != c.covers {
+			t.Error("CoversPattern", c.grant, c.pattern, "is not", c.covers)
+		}
+	}
+}
+
+func TestIsChannelPattern(t *testing.T) {
+	for _, cid := range []string{"site1.*", "site1.>", "*", "a.*.b"} {
+		if !IsChannelPattern(cid) {
+			t.Error("not a pattern:", cid)
+		}
+	}
+	for _, cid := range []string{"site1", "site1.floor2", "site1.a*", "a>"} {
+		if IsChannelPattern(cid) {
+			t.Error("a pattern:", cid)
+		}
+	}
+}
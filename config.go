@@ -7,20 +7,44 @@ import (
 	"saassoft.net/signaldistribution/base"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
-	ServiceMode  base.ServiceMode
-	ServicePort  int
-	PublishPort  int
-	PublishIP    string
-	StationMode  base.StationMode
-	RouteServers []string
-	Recorders    []string
-	ServiceSID   string
-	ReadErrors   []error
-	ConfigFile   *goconfig.ConfigFile
-	Nats         map[string]string
+	ServiceMode      base.ServiceMode
+	ServicePort      int
+	PublishPort      int
+	PublishIP        string
+	StationMode      base.StationMode
+	RouteServers     []string
+	Recorders        []string
+	ServiceSID       string
+	ReadErrors       []error
+	ConfigFile       *goconfig.ConfigFile
+	Nats             map[string]string
+	AuthSecret       string
+	ClientQueue      base.QueuePolicy
+	RelayQueue       base.QueuePolicy
+	RecorderQueue    base.QueuePolicy
+	HistorySize      int
+	ReliableChannels []string
+	MaxUnacked       int
+	RequestTimeout   time.Duration
+	ClientLimit      base.RateLimit
+	ChannelLimit     base.RateLimit
+	StationLimit     base.RateLimit
+	MaxFrameSize     int
+	MaxViolations    int
+	MaxChannels      int
+	MaxChannelSize   int
+	MaxClients       int
+	Heartbeat        base.HeartbeatPolicy
+	ShutdownTimeout  time.Duration
+	Interceptors     []string
+	WebhookURLs      []string
+	WebhookSecret    string
+	WebhookEvents    []string
+	AdminSecret      string
 }
 
 func (this *Config) LoadFromFile() []error {
@@ -32,12 +56,21 @@ func (this *Config) LoadFromFile() []error {
 		this.read_section_service()
 		if this.IsStation() {
 			this.read_section_station()
+			this.read_section_auth()
+			this.read_section_webhook()
+			this.read_section_admin()
 		}
 		if this.IsRoute() {
 			this.read_section_route()
+			if !this.IsStation() {
+				this.read_section_auth()
+			}
 		}
 		if this.IsRecorder() {
 			this.read_section_recorder()
+			if !this.IsStation() && !this.IsRoute() {
+				this.read_section_auth()
+			}
 		}
 	}
 	this.setDefault()
@@ -92,6 +125,9 @@ func (this *Config) setDefault() {
 	if this.RouteServers == nil {
 		this.RouteServers = []string{}
 	}
+	if this.ShutdownTimeout <= 0 {
+		this.ShutdownTimeout = base.DEFAULT_SHUTDOWN_TIMEOUT
+	}
 }
 
 func (this *Config) read_section_service() {
@@ -100,6 +136,35 @@ func (this *Config) read_section_service() {
 	this.read_service_port()
 	this.read_service_publiship()
 	this.read_service_publishport()
+	this.read_service_heartbeat()
+	this.read_service_shutdowntimeout()
+}
+
+func (this *Config) read_service_shutdowntimeout() {
+	value, err := this.ConfigFile.Int("service", "shutdowntimeout")
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read service shutdowntimeout:"+err.Error()))
+	}
+	if value > 0 {
+		this.ShutdownTimeout = time.Duration(value) * time.Millisecond
+	}
+}
+
+func (this *Config) read_service_heartbeat() {
+	value, err := this.ConfigFile.Int("service", "heartbeat")
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read service heartbeat:"+err.Error()))
+	}
+	if value > 0 {
+		this.Heartbeat.Interval = time.Duration(value) * time.Millisecond
+	}
+	value, err = this.ConfigFile.Int("service", "readtimeout")
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read service readtimeout:"+err.Error()))
+	}
+	if value > 0 {
+		this.Heartbeat.Timeout = time.Duration(value) * time.Millisecond
+	}
 }
 
 func (this *Config) read_service_mode() {
@@ -157,6 +222,122 @@ func (this *Config) read_section_station() {
 	this.read_station_mode()
 	this.read_station_routeservers()
 	this.read_station_recorders()
+	this.read_station_queues()
+	this.read_station_historysize()
+	this.read_station_reliablechannels()
+	this.read_station_requesttimeout()
+	this.read_station_limits()
+	this.read_station_capacity()
+	this.read_station_interceptors()
+}
+
+func (this *Config) read_station_interceptors() {
+	value, err := this.ConfigFile.GetValue("station", "interceptors")
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read station interceptors:"+err.Error()))
+	}
+	this.Interceptors = []string{}
+	for _, name := range strings.Split(value, ";") {
+		if name = strings.TrimSpace(name); name != "" {
+			this.Interceptors = append(this.Interceptors, name)
+		}
+	}
+}
+
+func (this *Config) read_station_limits() {
+	this.ClientLimit = this.read_station_limit("clientlimit")
+	this.ChannelLimit = this.read_station_limit("channellimit")
+	this.StationLimit = this.read_station_limit("stationlimit")
+	value, err := this.ConfigFile.Int("station", "maxframesize")
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read station maxframesize:"+err.Error()))
+	}
+	if value > 0 {
+		this.MaxFrameSize = value
+	}
+	value, err = this.ConfigFile.Int("station", "maxviolations")
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read station maxviolations:"+err.Error()))
+	}
+	if value > 0 {
+		this.MaxViolations = value
+	}
+}
+
+func (this *Config) read_station_capacity() {
+	value, err := this.ConfigFile.Int("station", "maxchannels")
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read station maxchannels:"+err.Error()))
+	}
+	if value > 0 {
+		this.MaxChannels = value
+	}
+	value, err = this.ConfigFile.Int("station", "maxchannelsize")
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read station maxchannelsize:"+err.Error()))
+	}
+	if value > 0 {
+		this.MaxChannelSize = value
+	}
+	value, err = this.ConfigFile.Int("station", "maxclients")
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read station maxclients:"+err.Error()))
+	}
+	if value > 0 {
+		this.MaxClients = value
+	}
+}
+
+func (this *Config) read_station_limit(key string) base.RateLimit {
+	value, err := this.ConfigFile.GetValue("station", key)
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read station "+key+":"+err.Error()))
+	}
+	limit, err := base.ParseRateLimit(strings.TrimSpace(value))
+	if err != nil {
+		this.ReadErrors = append(this.ReadErrors, errors.New("read station "+key+":"+err.Error()))
+	}
+	return limit
+}
+
+func (this *Config) read_station_requesttimeout() {
+	value, err := this.ConfigFile.Int("station", "requesttimeout")
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read station requesttimeout:"+err.Error()))
+	}
+	if value > 0 {
+		this.RequestTimeout = time.Duration(value) * time.Millisecond
+	}
+}
+
+func (this *Config) read_station_reliablechannels() {
+	value, err := this.ConfigFile.GetValue("station", "reliablechannels")
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read station reliablechannels:"+err.Error()))
+	}
+	this.ReliableChannels = []string{}
+	for _, pattern := range strings.Split(value, ";") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			this.ReliableChannels = append(this.ReliableChannels, pattern)
+		}
+	}
+	count, err := this.ConfigFile.Int("station", "maxunacked")
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read station maxunacked:"+err.Error()))
+	}
+	if count > 0 {
+		this.MaxUnacked = count
+	}
+}
+
+func (this *Config) read_station_historysize() {
+	value, err := this.ConfigFile.Int("station", "historysize")
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read station historysize:"+err.Error()))
+	}
+	if value > 0 {
+		this.HistorySize = value
+	}
 }
 
 func (this *Config) read_station_mode() {
@@ -221,6 +402,80 @@ func (this *Config) read_station_recorders() {
 	}
 }
 
+func (this *Config) read_station_queues() {
+	size, err := this.ConfigFile.Int("station", "queuesize")
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read station queuesize:"+err.Error()))
+	}
+	this.ClientQueue = this.read_station_queue("clientoverflow", size)
+	this.RelayQueue = this.read_station_queue("relayoverflow", size)
+	this.RecorderQueue = this.read_station_queue("recorderoverflow", size)
+}
+
+func (this *Config) read_station_queue(key string, size int) base.QueuePolicy {
+	value, err := this.ConfigFile.GetValue("station", key)
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read station "+key+":"+err.Error()))
+	}
+	policy, err := base.ParseQueuePolicy(strings.TrimSpace(value), size)
+	if err != nil {
+		this.ReadErrors = append(this.ReadErrors, errors.New("read station "+key+":"+err.Error()))
+	}
+	return policy
+}
+
+func (this *Config) read_section_webhook() {
+	this.WebhookURLs = this.read_webhook_list("urls")
+	this.WebhookEvents = this.read_webhook_list("events")
+	value, err := this.ConfigFile.GetValue("webhook", "secret")
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read webhook secret:"+err.Error()))
+	}
+	this.WebhookSecret = value
+}
+
+func (this *Config) read_webhook_list(key string) []string {
+	value, err := this.ConfigFile.GetValue("webhook", key)
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read webhook "+key+":"+err.Error()))
+	}
+	list := []string{}
+	for _, item := range strings.Split(value, ";") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (this *Config) read_section_auth() {
+	this.read_auth_secret()
+}
+
+func (this *Config) read_auth_secret() {
+	value, err := this.ConfigFile.GetValue("auth", "secret")
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read auth secret:"+err.Error()))
+	}
+	if value != "" {
+		this.AuthSecret = strings.TrimSpace(value)
+	}
+}
+
+func (this *Config) read_section_admin() {
+	this.read_admin_secret()
+}
+
+func (this *Config) read_admin_secret() {
+	value, err := this.ConfigFile.GetValue("admin", "secret")
+	if err != nil {
+		//this.ReadErrors = append(this.ReadErrors, errors.New("read admin secret:"+err.Error()))
+	}
+	if value != "" {
+		this.AdminSecret = strings.TrimSpace(value)
+	}
+}
+
 func (this *Config) read_section_route() {
 	this.read_route_nats()
 }
@@ -2,14 +2,19 @@ package recorder
 
 import (
 	"code.google.com/p/go.net/websocket"
+	"errors"
 	"saassoft.net/signaldistribution/base"
 	"saassoft.net/signaldistribution/signal"
 	"strings"
+	"sync"
+	"time"
 )
 
+// SignalCache keeps the recorded signals of each channel, expired signals are purged periodically.
 type SignalCache struct {
 	ChannelSignals map[string][]*signal.Signal
 	Signals        map[string]bool
+	locker         sync.RWMutex
 }
 
 type Station struct {
@@ -18,18 +23,26 @@ type Station struct {
 	Info   *base.ServerInfo
 }
 
+// RecorderServer records the signals of the stations joined.
+// Heartbeat is the heartbeat of the links to the stations.
+// Authenticator authenticates the fetching of recorded signals by the token of the client, as the stations do.
 type RecorderServer struct {
-	Stations    map[string]*Station
-	SignalCache *SignalCache
-	Info        *base.ServerInfo
-	Token       string
+	Stations      map[string]*Station
+	SignalCache   *SignalCache
+	Info          *base.ServerInfo
+	Authenticator signal.Authenticator
+	Heartbeat     base.HeartbeatPolicy
 }
 
-func (this *RecorderServer) InitWith(info *base.ServerInfo, token string) {
+func (this *RecorderServer) InitWith(info *base.ServerInfo, authenticator signal.Authenticator) {
 	this.Info = info
-	this.Token = token
+	this.Authenticator = authenticator
+	if this.Authenticator == nil {
+		this.Authenticator = &signal.AnonymousAuthenticator{}
+	}
 	this.Stations = make(map[string]*Station)
 	this.SignalCache = &SignalCache{ChannelSignals: make(map[string][]*signal.Signal), Signals: make(map[string]bool)}
+	go this.purgeExpired()
 }
 
 func (this *RecorderServer) StationJoin(ws *websocket.Conn) {
@@ -44,7 +57,13 @@ func (this *RecorderServer) StationJoin(ws *websocket.Conn) {
 		Conn:   ws,
 		Info:   remoteInfo,
 	}
-	this.doRecord(ws)
+	codec := signal.NegotiateCodec(this.Info, remoteInfo)
+	stop := make(chan bool)
+	go this.Heartbeat.Run(stop, func() error {
+		return codec.Send(ws, &signal.SignalPack{Signal: signal.Signal{Type: base.SIGNALTYPE_BLANK}, Stations: []string{}})
+	})
+	this.doRecord(ws, codec)
+	close(stop)
 	this.Stations[remoteAddr] = nil
 	delete(this.Stations, remoteAddr)
 }
@@ -78,6 +97,7 @@ func (this *RecorderServer) Fetch(ws *websocket.Conn) {
 	var channelid string
 	var token string
 	var lastfrom string
+	var lastid string
 	signals := []*signal.Signal{}
 	request := ws.Request()
 	request.ParseForm()
@@ -92,15 +112,39 @@ func (this *RecorderServer) Fetch(ws *websocket.Conn) {
 		websocket.JSON.Send(ws, signals)
 		return
 	}
+	identity, err := this.Authenticator.Authenticate(channelid, token, request)
+	if err == nil && !identity.Can(channelid, base.PERMISSION_SUBSCRIBE) {
+		err = errors.New("no permission to subscribe")
+	}
+	if err != nil {
+		signals = append(signals, this.newError(err.Error()))
+		websocket.JSON.Send(ws, signals)
+		return
+	}
+	this.SignalCache.locker.RLock()
 	channelSignas := this.SignalCache.ChannelSignals[channelid]
+	this.SignalCache.locker.RUnlock()
 	if channelSignas == nil {
 		websocket.JSON.Send(ws, signals)
 		return
 	}
+	lastid = request.Form.Get("lastid")
 	lastfrom = request.Form.Get("lastfrom")
 	idx := 0
 	signalCount := len(channelSignas)
-	if lastfrom != "" {
+	if lastid != "" {
+		for idx = signalCount - 1; idx >= 0; idx-- {
+			if channelSignas[idx].ID == lastid {
+				break
+			}
+		}
+		if idx < 0 {
+			signals = append(signals, this.newError(base.ERROR_GAP))
+			websocket.JSON.Send(ws, signals)
+			return
+		}
+		idx++
+	} else if lastfrom != "" {
 		for idx = signalCount - 1; idx >= 0; idx-- {
 			if strings.HasPrefix(channelSignas[idx].Text, lastfrom) {
 				break
@@ -109,29 +153,61 @@ func (this *RecorderServer) Fetch(ws *websocket.Conn) {
 	}
 	if idx >= 0 {
 		for i := idx; i < signalCount; i++ {
-			signals = append(signals, channelSignas[i])
+			if !channelSignas[i].IsExpired() {
+				signals = append(signals, channelSignas[i])
+			}
 		}
 	}
 	websocket.JSON.Send(ws, signals)
 }
 
-func (this *RecorderServer) doRecord(ws *websocket.Conn) {
+func (this *RecorderServer) doRecord(ws *websocket.Conn, codec websocket.Codec) {
 	for {
 		var signalPack signal.SignalPack
-		if err := websocket.JSON.Receive(ws, &signalPack); err != nil {
+		this.Heartbeat.SetReadDeadline(ws)
+		if err := codec.Receive(ws, &signalPack); err != nil {
 			return
 		}
-		if signalPack.Signal.Type != base.SIGNALTYPE_BLANK {
-			if this.SignalCache.Signals[signalPack.Signal.ID] {
+		if signalPack.Signal.Type != base.SIGNALTYPE_BLANK && !signalPack.Signal.IsExpired() {
+			this.SignalCache.locker.Lock()
+			if !this.SignalCache.Signals[signalPack.Signal.ID] {
+				this.SignalCache.Signals[signalPack.Signal.ID] = true
+				if this.SignalCache.ChannelSignals[signalPack.CID] == nil {
+					this.SignalCache.ChannelSignals[signalPack.CID] = []*signal.Signal{}
+				}
+				this.SignalCache.ChannelSignals[signalPack.CID] = append(this.SignalCache.ChannelSignals[signalPack.CID], &signalPack.Signal)
+			}
+			this.SignalCache.locker.Unlock()
+		}
+	}
+}
+
+// purgeExpired removes the expired signals from the cache periodically, with their ids kept for removing duplicates.
+// A channel's signals are replaced by a new slice, so the slice being fetched is not modified.
+func (this *RecorderServer) purgeExpired() {
+	time.AfterFunc(base.RECORDER_PURGE_INTERVAL, func() {
+		this.SignalCache.locker.Lock()
+		for cid, channelSignals := range this.SignalCache.ChannelSignals {
+			kept := make([]*signal.Signal, 0, len(channelSignals))
+			for _, signal := range channelSignals {
+				if !signal.IsExpired() {
+					kept = append(kept, signal)
+				} else {
+					delete(this.SignalCache.Signals, signal.ID)
+				}
+			}
+			if len(kept) == len(channelSignals) {
 				continue
 			}
-			this.SignalCache.Signals[signalPack.Signal.ID] = true
-			if this.SignalCache.ChannelSignals[signalPack.CID] == nil {
-				this.SignalCache.ChannelSignals[signalPack.CID] = []*signal.Signal{}
+			if len(kept) == 0 {
+				delete(this.SignalCache.ChannelSignals, cid)
+			} else {
+				this.SignalCache.ChannelSignals[cid] = kept
 			}
-			this.SignalCache.ChannelSignals[signalPack.CID] = append(this.SignalCache.ChannelSignals[signalPack.CID], &signalPack.Signal)
 		}
-	}
+		this.SignalCache.locker.Unlock()
+		this.purgeExpired()
+	})
 }
 
 func (this *RecorderServer) newError(text string) *signal.Signal {
@@ -0,0 +1,95 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package recorder
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"saassoft.net/signaldistribution/base"
+	"saassoft.net/signaldistribution/signal"
+	"testing"
+	"time"
+)
+
+func fetch(t *testing.T, server *httptest.Server, query url.Values) []*signal.Signal {
+	ws, err := websocket.Dial("ws://"+server.Listener.Addr().String()+"/?"+query.Encode(), "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	signals := []*signal.Signal{}
+	if err := websocket.JSON.Receive(ws, &signals); err != nil {
+		t.Fatal(err)
+	}
+	return signals
+}
+
+// TestFetchIsAuthenticated fetches the recorded signals of a channel, only a valid token of the channel gets them.
+func TestFetchIsAuthenticated(t *testing.T) {
+	authenticator := &signal.HMACAuthenticator{Secret: []byte("secret")}
+	recorderServer := &RecorderServer{}
+	recorderServer.InitWith(&base.ServerInfo{SID: "r1"}, authenticator)
+	recorderServer.SignalCache.ChannelSignals["room"] = []*signal.Signal{{ID: "1", Type: base.SIGNALTYPE_SIGNAL, Text: "recorded"}}
+	server := httptest.NewServer(websocket.Handler(recorderServer.Fetch))
+	defer server.Close()
+
+	for _, token := range []string{"p1", authenticator.NewToken("other", "p1", "", time.Now().Add(time.Hour))} {
+		signals := fetch(t, server, url.Values{"cid": {"room"}, "token": {token}})
+		if len(signals) != 1 || signals[0].Type != base.SIGNALTYPE_ERROR {
+			t.Fatal("fetched without a valid token:", token)
+		}
+	}
+	signals := fetch(t, server, url.Values{"cid": {"room"}, "token": {authenticator.NewToken("room", "p1", "", time.Now().Add(time.Hour))}})
+	if len(signals) != 1 || signals[0].Text != "recorded" {
+		t.Fatal("recorded signals not fetched:", signals)
+	}
+}
+
+// TestRecordedSignalKeepsHeaders records a signal with headers from a station, by the json and the binary codec,
+// the fetched signal has the same headers.
+func TestRecordedSignalKeepsHeaders(t *testing.T) {
+	for _, binary := range []bool{false, true} {
+		recorderServer := &RecorderServer{}
+		recorderServer.InitWith(&base.ServerInfo{SID: "r1", Binary: binary}, nil)
+		mux := http.NewServeMux()
+		mux.Handle("/", websocket.Handler(recorderServer.Fetch))
+		mux.Handle(base.RECORDER_STATION_JOIN_PATH, websocket.Handler(recorderServer.StationJoin))
+		server := httptest.NewServer(mux)
+
+		station := &signal.Station{}
+		station.InitWith(&base.ServerInfo{SID: "s1", IP: "127.0.0.1", Port: 1, Binary: binary}, nil)
+		go station.SetRecorders([]string{server.Listener.Addr().String()})
+		waitFor(t, "station to join", func() bool {
+			return len(station.Recorders()) == 1
+		})
+		headers := map[string]string{base.HEADER_ORIGIN_SID: "s1", "trace": "t1"}
+		station.Broadcast(&signal.SignalPack{
+			Signal:   signal.Signal{ID: "1", Type: base.SIGNALTYPE_SIGNAL, Text: "recorded", Headers: headers},
+			CID:      "room",
+			Time:     time.Now(),
+			Stations: []string{"remote"},
+		})
+		waitFor(t, "signal to be recorded", func() bool {
+			return len(fetch(t, server, url.Values{"cid": {"room"}, "token": {"p1"}})) == 1
+		})
+		signals := fetch(t, server, url.Values{"cid": {"room"}, "token": {"p1"}})
+		if signals[0].Headers["trace"] != "t1" || signals[0].Headers[base.HEADER_ORIGIN_SID] != "s1" {
+			t.Fatal("headers not recorded, binary:", binary, signals[0].Headers)
+		}
+		station.Close()
+		server.Close()
+	}
+}
+
+// waitFor waits until done returns true, it fails on timeout.
+func waitFor(t *testing.T, what string, done func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
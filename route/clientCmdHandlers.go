@@ -3,6 +3,7 @@
 package route
 
 import (
+	"encoding/json"
 	"log"
 	"saassoft.net/signaldistribution/base"
 	"strings"
@@ -23,6 +24,12 @@ func RegisterclientCmdHander() {
 	clientCmdHanders[base.ROUTECMDTYPE_RECORDERS] = clientCmdHandler_Recorders
 	clientCmdHanders[base.ROUTECMDTYPE_RECORDERJOIN] = clientCmdHandler_RecorderJoin
 	clientCmdHanders[base.ROUTECMDTYPE_RECORDERQUIT] = clientCmdHandler_RecorderQuit
+	clientCmdHanders[base.ROUTECMDTYPE_CHANNELS] = clientCmdHandler_Channels
+	clientCmdHanders[base.ROUTECMDTYPE_CHANNELJOIN] = clientCmdHandler_ChannelJoin
+	clientCmdHanders[base.ROUTECMDTYPE_CHANNELQUIT] = clientCmdHandler_ChannelQuit
+	clientCmdHanders[base.ROUTECMDTYPE_STATIONQUIT] = clientCmdHandler_StationQuit
+	clientCmdHanders[base.ROUTECMDTYPE_CAPACITY] = clientCmdHandler_Capacity
+	clientCmdHanders[base.ROUTECMDTYPE_MODERATION] = clientCmdHandler_Moderation
 }
 
 func ClientCmdHander(routeServer *RouteServer, from *Station, cmd base.RouteCmd) {
@@ -105,3 +112,68 @@ func clientCmdHandler_RecorderQuit(routeServer *RouteServer, from *Station, cmdT
 	from.RemoveRecorder(cmdText)
 	routeServer.structureChange()
 }
+
+func clientCmdHandler_Channels(routeServer *RouteServer, from *Station, cmdText string) {
+	var presences []*base.Presence
+	if err := json.Unmarshal([]byte(cmdText), &presences); err != nil {
+		return
+	}
+	for _, presence := range presences {
+		from.AppendClientChannel(presence)
+	}
+	routeServer.structureChange()
+}
+
+func clientCmdHandler_ChannelJoin(routeServer *RouteServer, from *Station, cmdText string) {
+	var presence base.Presence
+	if err := json.Unmarshal([]byte(cmdText), &presence); err != nil {
+		return
+	}
+	from.AppendClientChannel(&presence)
+	routeServer.structureChange()
+}
+
+func clientCmdHandler_ChannelQuit(routeServer *RouteServer, from *Station, cmdText string) {
+	var presence base.Presence
+	if err := json.Unmarshal([]byte(cmdText), &presence); err != nil {
+		return
+	}
+	from.RemoveClientChannel(&presence)
+	routeServer.structureChange()
+}
+
+// clientCmdHandler_StationQuit releases the station that is shutting down, so no client is routed to it.
+func clientCmdHandler_StationQuit(routeServer *RouteServer, from *Station, cmdText string) {
+	log.Println("route server - station: shutting down:", from.SID)
+	routeServer.removeStation(from)
+	routeServer.structureChange()
+}
+
+// clientCmdHandler_Capacity keeps the capacity of the station, a full station is skipped by routing.
+func clientCmdHandler_Capacity(routeServer *RouteServer, from *Station, cmdText string) {
+	var capacity base.Capacity
+	if err := json.Unmarshal([]byte(cmdText), &capacity); err != nil {
+		log.Println("route server - station: bad capacity:", from.SID, err)
+		return
+	}
+	from.SetCapacity(capacity)
+}
+
+// clientCmdHandler_Moderation keeps the ban or the mute reported by the station, and orders the admin action to other stations.
+// A ban or a mute already kept is reported again by a reconnecting station, it is not ordered again.
+func clientCmdHandler_Moderation(routeServer *RouteServer, from *Station, cmdText string) {
+	var moderation base.Moderation
+	if err := json.Unmarshal([]byte(cmdText), &moderation); err != nil {
+		log.Println("route server - station: bad moderation:", from.SID, err)
+		return
+	}
+	if !routeServer.keepModeration(&moderation) {
+		return
+	}
+	cmd := &base.RouteCmd{Type: base.ROUTECMDTYPE_MODERATION, Text: cmdText}
+	for _, s := range routeServer.Stations {
+		if s != from {
+			go routeServer.orderStation(s, cmd)
+		}
+	}
+}
@@ -6,6 +6,7 @@ package route
 import (
 	"saassoft.net/signaldistribution/base"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,16 +22,32 @@ type Recorder struct {
 
 // Station represents the base information of a station server.
 type Station struct {
-	SID         string
-	Mode        base.StationMode
-	RemoteInfo  base.RemoteInfo
-	PublishAddr string
-	Time        time.Time
-	Clients     map[string]time.Time
-	Recorders   map[string]*Recorder
-	IsOnline    bool
-	TrunkRelays map[string]*Relay
-	Relays      map[string]*Relay
+	SID          string
+	Mode         base.StationMode
+	RemoteInfo   base.RemoteInfo
+	PublishAddr  string
+	Time         time.Time
+	Clients      map[string]*Client
+	Recorders    map[string]*Recorder
+	IsOnline     bool
+	TrunkRelays  map[string]*Relay
+	Relays       map[string]*Relay
+	capacity     base.Capacity
+	capacityLock sync.RWMutex
+}
+
+// SetCapacity keeps the capacity reported by the station.
+func (this *Station) SetCapacity(capacity base.Capacity) {
+	this.capacityLock.Lock()
+	defer this.capacityLock.Unlock()
+	this.capacity = capacity
+}
+
+// IsFull returns true if the station has reached its limit of clients or channels.
+func (this *Station) IsFull() bool {
+	this.capacityLock.RLock()
+	defer this.capacityLock.RUnlock()
+	return this.capacity.IsFull()
 }
 
 // RemoveRecorder removes the relationship between a recorder and the station.
@@ -65,7 +82,35 @@ func (this *Station) RemoveClient(upid string) {
 
 // AppendClient appends a relationship between a client and the station.
 func (this *Station) AppendClient(upid string) {
-	this.Clients[upid] = time.Now()
+	if this.Clients[upid] == nil {
+		this.Clients[upid] = &Client{UPID: upid, Time: time.Now(), Channels: make(map[string]time.Time)}
+	}
+}
+
+// AppendClientChannel appends a relationship between a client of the station and the channel it joined in.
+func (this *Station) AppendClientChannel(presence *base.Presence) {
+	this.AppendClient(presence.UPID)
+	client := this.Clients[presence.UPID]
+	client.PID = presence.PID
+	client.Channels[presence.CID] = presence.Time
+}
+
+// RemoveClientChannel removes the relationship between a client of the station and the channel it quitted from.
+func (this *Station) RemoveClientChannel(presence *base.Presence) {
+	if client := this.Clients[presence.UPID]; client != nil {
+		delete(client.Channels, presence.CID)
+	}
+}
+
+// Presences returns the participants in the channel of the station.
+func (this *Station) Presences(cid string) []*base.Presence {
+	presences := []*base.Presence{}
+	for upid, client := range this.Clients {
+		if joinTime, ok := client.Channels[cid]; ok {
+			presences = append(presences, &base.Presence{CID: cid, PID: client.PID, UPID: upid, SID: this.SID, Time: joinTime})
+		}
+	}
+	return presences
 }
 
 // RemoveTrunkRelay removes the relationship between a trunk station and the station when it runs as trunk mode.
@@ -106,6 +151,14 @@ func (this *Station) ExistsRelay(upid string) bool {
 	return this.Relays[upid] != nil
 }
 
+// Client represents the base information of an end-client connected to a station.
+type Client struct {
+	UPID     string
+	PID      string
+	Time     time.Time
+	Channels map[string]time.Time
+}
+
 // Relay represents the base information of a relay between two stations.
 type Relay struct {
 	FromSID string
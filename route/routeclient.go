@@ -4,13 +4,21 @@ package route
 
 import (
 	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"errors"
 	"log"
+	"net/http"
+	"net/url"
 	"saassoft.net/signaldistribution/base"
 	"saassoft.net/signaldistribution/signal"
 	"strings"
 	"time"
 )
 
+// RouteClient registers the station to a route server and reports the changes of the station to it.
+// The changes are queued and sent in order by one goroutine, so the route server applies them in the order they happen.
+// When the queue is full the connection is reset, the queued changes are discarded on reconnecting,
+// as the station reports its whole state again then.
 type RouteClient struct {
 	RouteCmdHander func(*signal.Station, base.RouteCmd)
 	Station        *signal.Station
@@ -18,20 +26,49 @@ type RouteClient struct {
 	cmds           chan *base.RouteCmd
 	serverConn     *websocket.Conn
 	enabled        bool
+	deregistered   bool
 }
 
 func (this *RouteClient) Register() {
-	this.cmds = make(chan *base.RouteCmd, 100)
+	this.cmds = make(chan *base.RouteCmd, base.ROUTE_QUEUE_SIZE)
 	go this.connServer()
 }
 
-func (this *RouteClient) Report(cmd *base.RouteCmd) {
-	if this.enabled {
-		this.cmds <- cmd
+// Report queues the cmd to be sent to the route server, it does not block.
+// It returns an error if the cmd is not queued, the state reported after reconnecting covers it then.
+func (this *RouteClient) Report(cmd *base.RouteCmd) error {
+	if !this.enabled {
+		return errors.New("not registered to route server: " + this.ServerAddr)
 	}
+	select {
+	case this.cmds <- cmd:
+		return nil
+	default:
+		log.Println("station - route client: report queue is full, reconnecting:", this.ServerAddr)
+		if conn := this.serverConn; conn != nil {
+			conn.Close()
+		}
+		return errors.New("report queue is full: " + this.ServerAddr)
+	}
+}
+
+// Deregister reports the departure of the station to the route server, and stops reconnecting to it.
+func (this *RouteClient) Deregister() {
+	this.deregistered = true
+	this.enabled = false
+	if this.serverConn == nil {
+		return
+	}
+	if err := this.doReport(&base.RouteCmd{Type: base.ROUTECMDTYPE_STATIONQUIT, Text: this.Station.Info.SID}); err != nil {
+		log.Println("station - route client: deregister error:", err)
+	}
+	this.serverConn.Close()
 }
 
 func (this *RouteClient) connServer() {
+	if this.deregistered {
+		return
+	}
 	defer time.AfterFunc(base.STATION_TRY_RECONNECT_ROUTESERVER_INTERVAL, this.connServer)
 	if this.serverConn != nil {
 		this.serverConn.Close()
@@ -58,9 +95,17 @@ func (this *RouteClient) connServer() {
 
 	this.serverConn = ws
 	log.Println("station - route client: registered to server:", this.ServerAddr)
+	this.discardReports()
+	this.enabled = true
 	this.reportStationInfo()
-	go this.enableReport()
+	stop := make(chan bool)
+	go this.sendReports(stop)
+	go this.Station.Heartbeat.Run(stop, func() error {
+		return this.doReport(&base.RouteCmd{Type: base.ROUTECMDTYPE_BLANK})
+	})
+	go base.HeartbeatPolicy{Interval: base.STATION_REPORT_CAPACITY_INTERVAL}.Run(stop, this.reportCapacity)
 	this.standby()
+	close(stop)
 }
 
 func (this *RouteClient) reportStationInfo() {
@@ -85,22 +130,83 @@ func (this *RouteClient) reportStationInfo() {
 
 	channels := this.Station.Channels()
 	var clientsString string
+	presences := []*base.Presence{}
 	for _, channel := range channels {
 		clients := channel.Clients()
 		for upid, _ := range clients {
 			clientsString = clientsString + upid + ";"
 		}
+		presences = append(presences, channel.Presences()...)
 	}
 	if clientsString != "" {
 		cmd := &base.RouteCmd{Type: base.ROUTECMDTYPE_CLIENTS, Text: clientsString}
 		this.doReport(cmd)
 	}
+	if len(presences) > 0 {
+		if text, err := json.Marshal(presences); err == nil {
+			cmd := &base.RouteCmd{Type: base.ROUTECMDTYPE_CHANNELS, Text: string(text)}
+			this.doReport(cmd)
+		}
+	}
+	// the route server keeps the moderations in memory only, so they are restored after it restarts
+	for _, moderation := range this.Station.Moderations() {
+		if text, err := json.Marshal(moderation); err == nil {
+			cmd := &base.RouteCmd{Type: base.ROUTECMDTYPE_MODERATION, Text: string(text)}
+			this.doReport(cmd)
+		}
+	}
+	this.reportCapacity()
 }
 
-func (this *RouteClient) enableReport() {
-	this.enabled = true
-	for cmd := range this.cmds {
-		if err := this.doReport(cmd); err != nil {
+// reportCapacity reports the count of clients and channels of the station and the limits of them.
+func (this *RouteClient) reportCapacity() error {
+	text, err := json.Marshal(this.Station.Capacity())
+	if err != nil {
+		return err
+	}
+	return this.doReport(&base.RouteCmd{Type: base.ROUTECMDTYPE_CAPACITY, Text: string(text)})
+}
+
+// Presences queries the participants in the channel of the cluster from the route server,
+// with the token of the client and the cid the token is issued for.
+func (this *RouteClient) Presences(cid string, tokenCID string, token string) ([]*base.Presence, error) {
+	client := &http.Client{Timeout: base.STATION_QUERY_PRESENCE_TIMEOUT}
+	query := url.Values{"cid": {cid}, "tokencid": {tokenCID}, "token": {token}}
+	resp, err := client.Get("http://" + this.ServerAddr + base.ROUTE_PRESENCE_PATH + "?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("route server: " + resp.Status)
+	}
+	var presences []*base.Presence
+	if err := json.NewDecoder(resp.Body).Decode(&presences); err != nil {
+		return nil, err
+	}
+	return presences, nil
+}
+
+// sendReports sends the queued cmds in order until stop is closed.
+func (this *RouteClient) sendReports(stop chan bool) {
+	for {
+		select {
+		case cmd := <-this.cmds:
+			if err := this.doReport(cmd); err != nil {
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// discardReports discards the queued cmds, the whole state reported after reconnecting covers them.
+func (this *RouteClient) discardReports() {
+	for {
+		select {
+		case <-this.cmds:
+		default:
 			return
 		}
 	}
@@ -113,11 +219,12 @@ func (this *RouteClient) doReport(cmd *base.RouteCmd) error {
 func (this *RouteClient) standby() {
 	for {
 		var cmd base.RouteCmd
+		this.Station.Heartbeat.SetReadDeadline(this.serverConn)
 		if err := websocket.JSON.Receive(this.serverConn, &cmd); err != nil {
-			log.Println("station - route client: disconnected:", this.serverUri)
+			log.Println("station - route client: disconnected:", this.serverUri())
 			return
 		}
-		if this.RouteCmdHander != nil {
+		if cmd.Type != base.ROUTECMDTYPE_BLANK && this.RouteCmdHander != nil {
 			this.RouteCmdHander(this.Station, cmd)
 		}
 	}
@@ -9,6 +9,7 @@ import (
 	"saassoft.net/signaldistribution/base"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,18 +18,28 @@ import (
 // 1. plans the relationship of the stations;
 // 2. checks the availability of the stations;
 // 3. routes the end-client to an available station and an available recorder server;
+// RouteServer manages the structure of the cluster.
+// Heartbeat is the heartbeat of the links to the stations.
+// The bans and the mutes reported by the stations are kept, and ordered to the stations joining later.
+// structureLock guards the stations with their clients, relays and recorders, and the real time readers,
+// the route commands of the stations are handled with it held.
 type RouteServer struct {
 	Stations        map[string]*Station
 	Time            time.Time
 	RouteCmdHander  func(*RouteServer, *Station, base.RouteCmd)
 	changeChan      chan bool
 	realTimeReaders map[string]*websocket.Conn
+	Heartbeat       base.HeartbeatPolicy
+	moderations     map[string]*base.Moderation
+	moderationLock  sync.Mutex
+	structureLock   sync.RWMutex
 }
 
 // Run starts to service
 func (this *RouteServer) Run() {
 	this.Stations = make(map[string]*Station)
 	this.realTimeReaders = make(map[string]*websocket.Conn)
+	this.moderations = make(map[string]*base.Moderation)
 	this.Time = time.Now()
 	this.changeChan = make(chan bool)
 	go this.handleChange()
@@ -45,17 +56,27 @@ func (this *RouteServer) Register(ws *websocket.Conn) {
 	defer this.releaseStation(station)
 	log.Println("route server - station: joined:", station.SID)
 	this.structureChange()
+	this.structureLock.RLock()
 	this.planRelay(station)
+	this.structureLock.RUnlock()
+	this.orderModerations(station)
+	stop := make(chan bool)
+	go this.Heartbeat.Run(stop, func() error {
+		return websocket.JSON.Send(station.RemoteInfo.Conn, &base.RouteCmd{Type: base.ROUTECMDTYPE_BLANK})
+	})
 	this.listenStation(station)
+	close(stop)
 	this.structureChange()
 	log.Println("route server - station: quited:", station.SID)
 	station = nil
 }
 
-// Route accepts the end-client to request route.
+// Route accepts the end-client to request route, the station with the fewest clients is picked, full stations are skipped.
 func (this *RouteServer) Route(ws *websocket.Conn) {
 	var pickedStation *Station
 	var pickedRecorder string
+	this.structureLock.RLock()
+	defer this.structureLock.RUnlock()
 	for _, st := range this.Stations {
 		if pickedRecorder == "" && len(st.Recorders) > 0 {
 			for _, recorder := range st.Recorders {
@@ -63,6 +84,9 @@ func (this *RouteServer) Route(ws *websocket.Conn) {
 				break
 			}
 		}
+		if st.IsFull() {
+			continue
+		}
 		if pickedStation == nil {
 			pickedStation = st
 			continue
@@ -89,10 +113,14 @@ func (this *RouteServer) Route(ws *websocket.Conn) {
 func (this *RouteServer) RealTime(ws *websocket.Conn) {
 	rtId := ws.Request().RemoteAddr
 	log.Println("route server - real time reader: joined:", rtId)
+	this.structureLock.Lock()
 	this.realTimeReaders[rtId] = ws
+	this.structureLock.Unlock()
 	defer func(rtId string) {
+		this.structureLock.Lock()
 		this.realTimeReaders[rtId] = nil
 		delete(this.realTimeReaders, rtId)
+		this.structureLock.Unlock()
 		log.Println("route server - real time reader: quited:", rtId)
 	}(rtId)
 	websocket.Message.Send(ws, this.StructureString())
@@ -101,6 +129,8 @@ func (this *RouteServer) RealTime(ws *websocket.Conn) {
 
 // Structure returns the structure of the cluster .
 func (this *RouteServer) Structure() []*Station {
+	this.structureLock.RLock()
+	defer this.structureLock.RUnlock()
 	var stations []*Station
 	for _, s := range this.Stations {
 		stations = append(stations, s)
@@ -108,8 +138,25 @@ func (this *RouteServer) Structure() []*Station {
 	return stations
 }
 
+// Presences returns the participants in the channel of every station in the cluster.
+func (this *RouteServer) Presences(cid string) []*base.Presence {
+	this.structureLock.RLock()
+	defer this.structureLock.RUnlock()
+	presences := []*base.Presence{}
+	for _, s := range this.Stations {
+		presences = append(presences, s.Presences(cid)...)
+	}
+	return presences
+}
+
 // StructureString returns the structure of the cluster.
 func (this *RouteServer) StructureString() string {
+	this.structureLock.RLock()
+	defer this.structureLock.RUnlock()
+	return this.structureString()
+}
+
+func (this *RouteServer) structureString() string {
 	var stations []*Station
 	var jsonString string
 	for _, s := range this.Stations {
@@ -157,11 +204,13 @@ func (this *RouteServer) initStation(ws *websocket.Conn) (*Station, error) {
 		},
 		TrunkRelays: make(map[string]*Relay),
 		Relays:      make(map[string]*Relay),
-		Clients:     make(map[string]time.Time),
+		Clients:     make(map[string]*Client),
 		Recorders:   make(map[string]*Recorder),
 		Time:        time.Now(),
 	}
+	this.structureLock.Lock()
 	this.Stations[ipAddr] = station
+	this.structureLock.Unlock()
 	return station, nil
 }
 
@@ -170,8 +219,15 @@ func (this *RouteServer) handleChange() {
 		if !b {
 			return
 		}
+		this.structureLock.RLock()
+		structure := this.structureString()
+		readers := make([]*websocket.Conn, 0, len(this.realTimeReaders))
 		for _, rtr := range this.realTimeReaders {
-			if err := websocket.Message.Send(rtr, this.StructureString()); err != nil {
+			readers = append(readers, rtr)
+		}
+		this.structureLock.RUnlock()
+		for _, rtr := range readers {
+			if err := websocket.Message.Send(rtr, structure); err != nil {
 			}
 		}
 	}
@@ -182,6 +238,8 @@ func (this *RouteServer) checkRelays() {
 	timer := time.NewTimer(base.ROUTE_SERVER_CHECKRELAYS_INTERVAL)
 	<-timer.C
 	timer = nil
+	this.structureLock.RLock()
+	defer this.structureLock.RUnlock()
 	tss, _, _ := this.statonsClassify()
 	this.checkTrunkRelays(tss)
 }
@@ -308,19 +366,68 @@ func (this *RouteServer) orderStation(station *Station, cmd *base.RouteCmd) {
 	}
 }
 
+// keepModeration keeps the ban or the mute, or removes the one lifted by unban or unmute.
+// It returns false if the same ban or mute is kept already.
+func (this *RouteServer) keepModeration(moderation *base.Moderation) bool {
+	this.moderationLock.Lock()
+	defer this.moderationLock.Unlock()
+	for key, kept := range this.moderations {
+		if kept.IsExpired() {
+			delete(this.moderations, key)
+		}
+	}
+	switch moderation.Action {
+	case base.MODERATION_BAN, base.MODERATION_MUTE:
+		if kept := this.moderations[moderation.Key()]; kept != nil && kept.Expires.Equal(moderation.Expires) {
+			return false
+		}
+		this.moderations[moderation.Key()] = moderation
+	case base.MODERATION_UNBAN, base.MODERATION_UNMUTE:
+		delete(this.moderations, moderation.Key())
+	}
+	return true
+}
+
+// orderModerations orders the bans and the mutes in effect to the station.
+func (this *RouteServer) orderModerations(station *Station) {
+	this.moderationLock.Lock()
+	defer this.moderationLock.Unlock()
+	for _, moderation := range this.moderations {
+		if moderation.IsExpired() {
+			continue
+		}
+		if text, err := json.Marshal(moderation); err == nil {
+			go this.orderStation(station, &base.RouteCmd{Type: base.ROUTECMDTYPE_MODERATION, Text: string(text)})
+		}
+	}
+}
+
 func (this *RouteServer) listenStation(station *Station) {
 	for {
 		var cmd base.RouteCmd
+		this.Heartbeat.SetReadDeadline(station.RemoteInfo.Conn)
 		if err := websocket.JSON.Receive(station.RemoteInfo.Conn, &cmd); err != nil {
 			return
 		}
 		if cmd.Type != base.ROUTECMDTYPE_BLANK && this.RouteCmdHander != nil {
+			this.structureLock.Lock()
 			this.RouteCmdHander(this, station, cmd)
+			this.structureLock.Unlock()
 		}
 	}
 }
 
 func (this *RouteServer) releaseStation(station *Station) {
+	this.structureLock.Lock()
+	defer this.structureLock.Unlock()
+	this.removeStation(station)
+}
+
+// removeStation removes the station from the structure, structureLock must be held.
+func (this *RouteServer) removeStation(station *Station) {
+	if this.Stations[station.RemoteInfo.IpAddr] != station {
+		return
+	}
 	this.Stations[station.RemoteInfo.IpAddr] = nil
 	delete(this.Stations, station.RemoteInfo.IpAddr)
 }
@@ -0,0 +1,83 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package route
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"saassoft.net/signaldistribution/base"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+	RegisterclientCmdHander()
+}
+
+// TestPresencesDuringChannelChurn reads the presences and the structure while a station reports joins and quits of channels.
+func TestPresencesDuringChannelChurn(t *testing.T) {
+	routeServer := &RouteServer{RouteCmdHander: ClientCmdHander}
+	routeServer.Run()
+	server := httptest.NewServer(websocket.Handler(routeServer.Register))
+	defer server.Close()
+
+	ws, err := websocket.Dial("ws://"+server.Listener.Addr().String()+"/", "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	var remoteAddr string
+	if err := websocket.JSON.Send(ws, &base.ServerInfo{SID: "s1", IP: "127.0.0.1", Port: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := websocket.JSON.Receive(ws, &remoteAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		for n := 0; n < 2000; n++ {
+			presence := &base.Presence{CID: "room", PID: "p", UPID: "p_" + strconv.Itoa(n%10), Time: time.Now()}
+			text, _ := json.Marshal(presence)
+			cmdType := base.RouteCmdType(base.ROUTECMDTYPE_CHANNELJOIN)
+			if n%2 == 1 {
+				cmdType = base.RouteCmdType(base.ROUTECMDTYPE_CHANNELQUIT)
+			}
+			if err := websocket.JSON.Send(ws, &base.RouteCmd{Type: cmdType, Text: string(text)}); err != nil {
+				done <- err
+				return
+			}
+		}
+		close(done)
+	}()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		default:
+		}
+		routeServer.Presences("room")
+		routeServer.StructureString()
+	}
+}
+
+// TestStationFullOfChannelsIsFull reports the capacity of a station with the max count of channels, it is full.
+func TestStationFullOfChannelsIsFull(t *testing.T) {
+	station := &Station{}
+	station.SetCapacity(base.Capacity{Clients: 1, MaxClients: 10, Channels: 5, MaxChannels: 5})
+	if !station.IsFull() {
+		t.Fatal("station with max channels is not full")
+	}
+	station.SetCapacity(base.Capacity{Clients: 1, MaxClients: 10, Channels: 4, MaxChannels: 5})
+	if station.IsFull() {
+		t.Fatal("station with room is full")
+	}
+}
@@ -3,6 +3,7 @@
 package route
 
 import (
+	"encoding/json"
 	"log"
 	"saassoft.net/signaldistribution/base"
 	"saassoft.net/signaldistribution/signal"
@@ -13,6 +14,7 @@ var routeCmdHanders map[base.RouteCmdType]func(*signal.Station, string)
 func RegisterServerCmdHander() {
 	routeCmdHanders = make(map[base.RouteCmdType]func(*signal.Station, string))
 	routeCmdHanders[base.ROUTECMDTYPE_RELAYWITH] = routeCmdHandler_RelayWith
+	routeCmdHanders[base.ROUTECMDTYPE_MODERATION] = routeCmdHandler_Moderation
 }
 
 func ServerCmdHander(station *signal.Station, cmd base.RouteCmd) {
@@ -26,3 +28,15 @@ func ServerCmdHander(station *signal.Station, cmd base.RouteCmd) {
 func routeCmdHandler_RelayWith(station *signal.Station, cmdText string) {
 	go station.RelayWithStation(cmdText)
 }
+
+// routeCmdHandler_Moderation applies the admin action ordered by the route server to the station.
+func routeCmdHandler_Moderation(station *signal.Station, cmdText string) {
+	var moderation base.Moderation
+	if err := json.Unmarshal([]byte(cmdText), &moderation); err != nil {
+		log.Println("station - route client: bad moderation:", err)
+		return
+	}
+	if err := station.ApplyModeration(&moderation); err != nil {
+		log.Println("station - route client: moderation error:", err)
+	}
+}
@@ -4,21 +4,30 @@ package main
 
 import (
 	"code.google.com/p/go.net/websocket"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	ossignal "os/signal"
 	"saassoft.net/signaldistribution/base"
 	"saassoft.net/signaldistribution/recorder"
 	"saassoft.net/signaldistribution/route"
 	"saassoft.net/signaldistribution/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var config *Config
 var station *signal.Station
 var routeClients []*route.RouteClient
 var routeServer *route.RouteServer
+var routeAuthenticator signal.Authenticator
 var recorderServer *recorder.RecorderServer
 var stopService chan bool
 var serverInfo base.ServerInfo
@@ -26,6 +35,7 @@ var serverInfo base.ServerInfo
 func StartRuntime() {
 	mylogger := base.MyLogger{}
 	log.SetOutput(mylogger)
+	stopService = make(chan bool)
 	initConfig()
 	initServerInfo()
 	startService()
@@ -47,6 +57,7 @@ func StartRuntime() {
 		log.Println("runtime: station service is enabled.")
 	}
 
+	go handleSignals()
 	waitForStop()
 	log.Println("runtime: service stoped.")
 }
@@ -55,6 +66,28 @@ func StopRuntime() {
 	stopService <- true
 }
 
+// handleSignals shuts down the runtime gracefully on SIGTERM or SIGINT.
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	ossignal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	<-signals
+	shutdown()
+}
+
+// shutdown stops accepting joins, redirects the clients to other stations, flushes the queues,
+// reports the departure to the route servers, then stops the runtime.
+func shutdown() {
+	log.Println("runtime: shutting down.")
+	if config.IsStation() {
+		station.Drain(config.ShutdownTimeout)
+		for _, routeClient := range routeClients {
+			routeClient.Deregister()
+		}
+		station.Close()
+	}
+	StopRuntime()
+}
+
 func initConfig() {
 	config = &Config{}
 	readerrors := config.LoadFromFile()
@@ -70,6 +103,7 @@ func initServerInfo() {
 	//serverInfo.IP = config.ServiceIP
 	serverInfo.Port = config.ServicePort
 	serverInfo.Mode = int(config.ServiceMode)
+	serverInfo.Binary = true
 }
 
 func enabledHTMLService() {
@@ -84,8 +118,35 @@ func initStationServer() {
 	station = &signal.Station{}
 	ssi := serverInfo
 	ssi.Mode = int(config.StationMode)
-	station.InitWith(&ssi, "token")
+	station.ClientQueue = config.ClientQueue
+	station.RelayQueue = config.RelayQueue
+	station.RecorderQueue = config.RecorderQueue
+	station.HistorySize = config.HistorySize
+	station.ReliableChannels = config.ReliableChannels
+	station.MaxUnacked = config.MaxUnacked
+	station.RequestTimeout = config.RequestTimeout
+	station.ClientLimit = config.ClientLimit
+	station.ChannelLimit = config.ChannelLimit
+	station.StationLimit = config.StationLimit
+	station.MaxFrameSize = config.MaxFrameSize
+	station.MaxViolations = config.MaxViolations
+	station.MaxChannels = config.MaxChannels
+	station.MaxChannelSize = config.MaxChannelSize
+	station.MaxClients = config.MaxClients
+	station.Heartbeat = config.Heartbeat
+	if err := station.UseInterceptors(config.Interceptors); err != nil {
+		panic("runtime: " + err.Error())
+	}
+	if len(config.WebhookURLs) > 0 && config.WebhookSecret == "" {
+		panic("runtime: webhook secret is not set, the requests to the webhook urls can not be verified")
+	}
+	for _, url := range config.WebhookURLs {
+		station.Webhooks = append(station.Webhooks, signal.NewWebhook(url, []byte(config.WebhookSecret), config.WebhookEvents))
+	}
+	station.InitWith(&ssi, newAuthenticator())
 	station.ChangeHandler = changeHandler
+	station.PresenceHandler = presenceHandler
+	station.AdminHandler = adminHandler
 	route.RegisterServerCmdHander()
 	routeClients = []*route.RouteClient{}
 	for _, routeServerAddr := range config.RouteServers {
@@ -98,31 +159,68 @@ func initStationServer() {
 	}
 	http.Handle(base.STATION_CLIENT_JOIN_PATH, websocket.Handler(station.ClientJoin))
 	http.Handle(base.STATION_RELAY_JOIN_PATH, websocket.Handler(station.RelayJoin))
+	http.HandleFunc(base.STATION_PRESENCE_PATH, stationPresence)
+	http.HandleFunc(base.STATION_ADMIN_PATH, stationAdmin)
+	http.HandleFunc(base.STATION_API_PATH, stationAPI)
+}
+
+func newAuthenticator() signal.Authenticator {
+	if config.AuthSecret == "" {
+		log.Println("runtime: no auth secret configured, clients join without authentication.")
+		return &signal.AnonymousAuthenticator{}
+	}
+	return &signal.HMACAuthenticator{Secret: []byte(config.AuthSecret)}
 }
 
 func changeHandler(upid string, cmdType int) {
 	cmd := &base.RouteCmd{Type: base.RouteCmdType(cmdType), Text: upid}
 	for _, routeClient := range routeClients {
-		go routeClient.Report(cmd)
+		routeClient.Report(cmd)
+	}
+}
+
+func presenceHandler(cid string, tokenCID string, token string) ([]*base.Presence, error) {
+	err := errors.New("no route server")
+	for _, routeClient := range routeClients {
+		var presences []*base.Presence
+		if presences, err = routeClient.Presences(cid, tokenCID, token); err == nil {
+			return presences, nil
+		}
+	}
+	return nil, err
+}
+
+func adminHandler(moderation *base.Moderation) {
+	text, err := json.Marshal(moderation)
+	if err != nil {
+		return
+	}
+	cmd := &base.RouteCmd{Type: base.ROUTECMDTYPE_MODERATION, Text: string(text)}
+	for _, routeClient := range routeClients {
+		if err := routeClient.Report(cmd); err != nil {
+			log.Println("runtime: moderation is not reported, bans and mutes are reported again after reconnecting:", err)
+		}
 	}
 }
 
 func initRouteServer() {
 	route.Nats = config.Nats
 	route.RegisterclientCmdHander()
-	routeServer = &route.RouteServer{RouteCmdHander: route.ClientCmdHander}
+	routeServer = &route.RouteServer{RouteCmdHander: route.ClientCmdHander, Heartbeat: config.Heartbeat}
+	routeAuthenticator = newAuthenticator()
 
 	routeServer.Run()
 	http.Handle(base.ROUTE_REGISTER_PATH, websocket.Handler(routeServer.Register))
 	http.Handle(base.ROUTE_REALTIME_PATH, websocket.Handler(routeServer.RealTime))
 	http.Handle(base.ROUTE_ROUTE_PATH, websocket.Handler(routeServer.Route))
 	http.HandleFunc(base.ROUTE_STATISTICS_PATH, routeStatistics)
+	http.HandleFunc(base.ROUTE_PRESENCE_PATH, routePresence)
 }
 
 func initRecorderServer() {
-	recorderServer = &recorder.RecorderServer{}
+	recorderServer = &recorder.RecorderServer{Heartbeat: config.Heartbeat}
 	rsi := serverInfo
-	recorderServer.InitWith(&rsi, "token")
+	recorderServer.InitWith(&rsi, newAuthenticator())
 	http.Handle(base.RECORDER_STATION_JOIN_PATH, websocket.Handler(recorderServer.StationJoin))
 	http.Handle(base.RECORDER_FETCH_PATH, websocket.Handler(recorderServer.Fetch))
 }
@@ -153,13 +251,117 @@ func stationStatistics(w http.ResponseWriter, req *http.Request) {
 	io.WriteString(w, "\nBroadcastedCount:"+strconv.Itoa(station.BroadcastedCount()))
 	io.WriteString(w, "\n")
 	io.WriteString(w, "\nClientCount:"+strconv.Itoa(station.ClientCount()))
+	violations := station.Violations()
+	io.WriteString(w, "\nViolations: Frame:"+strconv.FormatInt(violations.Frame, 10)+" Client:"+strconv.FormatInt(violations.Client, 10)+
+		" Channel:"+strconv.FormatInt(violations.Channel, 10)+" Station:"+strconv.FormatInt(violations.Station, 10))
 
 	channels := station.Channels()
 	for _, channel := range channels {
 		io.WriteString(w, "\nChannel:"+channel.CID+" Client Count:"+strconv.Itoa(channel.ClientCount()))
+		for upid, client := range channel.Clients() {
+			io.WriteString(w, "\n  Client:"+upid+" Dropped:"+strconv.FormatInt(client.Info.DroppedCount(), 10)+" Expired:"+strconv.FormatInt(client.Info.ExpiredCount(), 10)+
+				" Violations:"+strconv.FormatInt(client.ViolationCount(), 10))
+		}
+	}
+	io.WriteString(w, "\n")
+	for _, relay := range station.Relays() {
+		io.WriteString(w, "\nRelay:"+relay.Info.UPID+" Dropped:"+strconv.FormatInt(relay.Info.DroppedCount(), 10)+" Expired:"+strconv.FormatInt(relay.Info.ExpiredCount(), 10))
+	}
+	for _, recorder := range station.Recorders() {
+		io.WriteString(w, "\nRecorder:"+recorder.Info.UPID+" Dropped:"+strconv.FormatInt(recorder.Info.DroppedCount(), 10)+" Expired:"+strconv.FormatInt(recorder.Info.ExpiredCount(), 10))
 	}
 }
 
 func routeStatistics(w http.ResponseWriter, req *http.Request) {
 	io.WriteString(w, routeServer.StructureString())
 }
+
+// stationPresence writes the json of participants in the channel.
+// Query parameters: cid, token, tokencid is the cid the token is issued for, default is cid,
+// and scope=cluster for the participants of every station in the cluster.
+func stationPresence(w http.ResponseWriter, req *http.Request) {
+	if req.FormValue("cid") == "" {
+		http.Error(w, "no cid", http.StatusBadRequest)
+		return
+	}
+	cid, tokenCID, token, err := authorizePresence(station.Authenticator, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	presences := station.Presences(cid)
+	if req.FormValue("scope") == "cluster" {
+		if presences, err = station.ClusterPresences(cid, tokenCID, token); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(presences)
+}
+
+// routePresence writes the json of participants in the channel of every station in the cluster.
+// Query parameters are the same as stationPresence.
+func routePresence(w http.ResponseWriter, req *http.Request) {
+	if req.FormValue("cid") == "" {
+		http.Error(w, "no cid", http.StatusBadRequest)
+		return
+	}
+	cid, _, _, err := authorizePresence(routeAuthenticator, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(routeServer.Presences(cid))
+}
+
+// authorizePresence authenticates the token issued for tokencid, and checks it grants subscribing to cid.
+func authorizePresence(authenticator signal.Authenticator, req *http.Request) (string, string, string, error) {
+	cid, tokenCID, token := req.FormValue("cid"), req.FormValue("tokencid"), req.FormValue("token")
+	if tokenCID == "" {
+		tokenCID = cid
+	}
+	identity, err := authenticator.Authenticate(tokenCID, token, req)
+	if err != nil {
+		return "", "", "", err
+	}
+	if !identity.Can(cid, base.PERMISSION_SUBSCRIBE) {
+		return "", "", "", errors.New("no permission to subscribe")
+	}
+	return cid, tokenCID, token, nil
+}
+
+// stationAdmin applies the admin action at the end of the path to the participants, see base.Moderation.
+// Parameters: token is the admin secret, cid, id, ip, and duration in ms of bans and mutes, zero means forever.
+func stationAdmin(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if config.AdminSecret == "" || !hmac.Equal([]byte(req.FormValue("token")), []byte(config.AdminSecret)) {
+		http.Error(w, "bad token", http.StatusForbidden)
+		return
+	}
+	moderation := &base.Moderation{
+		Action: strings.TrimPrefix(req.URL.Path, base.STATION_ADMIN_PATH),
+		CID:    req.FormValue("cid"),
+		ID:     req.FormValue("id"),
+		IP:     req.FormValue("ip"),
+	}
+	if duration := req.FormValue("duration"); duration != "" {
+		ms, err := strconv.Atoi(duration)
+		if err != nil || ms < 0 {
+			http.Error(w, "bad duration", http.StatusBadRequest)
+			return
+		}
+		if ms > 0 {
+			moderation.Expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+	}
+	if err := station.Moderate(moderation); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
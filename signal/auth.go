@@ -0,0 +1,166 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"saassoft.net/signaldistribution/base"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Identity represents an authenticated participant.
+// An identity without grants is permitted to publish and subscribe on the channel it authenticated for only,
+// joining other channels requires grants, e.g. "pubsub@>" for every channel.
+type Identity struct {
+	PID     string
+	CID     string
+	Expires time.Time
+	Grants  []Grant
+}
+
+// Can returns true if the identity has the permission on the channel,
+// or on every channel matching cid if cid is a channel pattern.
+func (this *Identity) Can(cid string, permission base.Permission) bool {
+	if this == nil {
+		return true
+	}
+	if this.Grants == nil {
+		return cid == this.CID
+	}
+	isPattern := base.IsChannelPattern(cid)
+	for _, grant := range this.Grants {
+		if grant.Permission&permission != permission {
+			continue
+		}
+		if isPattern && base.CoversPattern(grant.Pattern, cid) || !isPattern && base.MatchChannel(grant.Pattern, cid) {
+			return true
+		}
+	}
+	return false
+}
+
+// Grant represents permissions on the channels whose cid matches the pattern.
+type Grant struct {
+	Pattern    string
+	Permission base.Permission
+}
+
+// ParseGrants parses the grants from text formed as "perm@pattern;perm@pattern",
+// perm is one of "pub", "sub" and "pubsub". Empty text returns nil grants.
+func ParseGrants(text string) ([]Grant, error) {
+	if text == "" {
+		return nil, nil
+	}
+	grants := []Grant{}
+	for _, item := range strings.Split(text, ";") {
+		if item == "" {
+			continue
+		}
+		idx := strings.Index(item, "@")
+		if idx <= 0 || idx == len(item)-1 {
+			return nil, errors.New("invalid grant: " + item)
+		}
+		var permission base.Permission
+		switch item[:idx] {
+		case "pub":
+			permission = base.PERMISSION_PUBLISH
+		case "sub":
+			permission = base.PERMISSION_SUBSCRIBE
+		case "pubsub":
+			permission = base.PERMISSION_PUBLISH | base.PERMISSION_SUBSCRIBE
+		default:
+			return nil, errors.New("invalid grant: " + item)
+		}
+		grants = append(grants, Grant{Pattern: item[idx+1:], Permission: permission})
+	}
+	return grants, nil
+}
+
+// Authenticator authenticates the end-client that joins in a channel of the station.
+// It returns the identity of the client, or an error if the client is rejected.
+type Authenticator interface {
+	Authenticate(cid string, token string, request *http.Request) (*Identity, error)
+}
+
+// AnonymousAuthenticator accepts every client, and uses the token as the pid of the client.
+// It keeps the behavior of the stations those have no secret configured, the client is granted every channel.
+type AnonymousAuthenticator struct {
+}
+
+// Authenticate returns an identity whose pid is the token.
+func (this *AnonymousAuthenticator) Authenticate(cid string, token string, request *http.Request) (*Identity, error) {
+	if token == "" {
+		return nil, errors.New("no token")
+	}
+	return &Identity{PID: token, CID: cid, Grants: anonymousGrants}, nil
+}
+
+var anonymousGrants = []Grant{{Pattern: ">", Permission: base.PERMISSION_PUBLISH | base.PERMISSION_SUBSCRIBE}}
+
+// HMACAuthenticator authenticates the client with a token signed by a shared secret.
+//
+// The token is formed as "pid:grants:expires:signature", grants is formed as ParseGrants accepts,
+// expires is an unix timestamp in seconds,
+// signature is the hex encoded HMAC-SHA256 of "cid:pid:grants:expires".
+// The cid and the pid must not contain ":", so the fields signed can not be shifted from one to another.
+type HMACAuthenticator struct {
+	Secret []byte
+}
+
+// NewToken returns a token that allows the participant with pid to join in the channel cid with grants until expires.
+func (this *HMACAuthenticator) NewToken(cid string, pid string, grants string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return pid + ":" + grants + ":" + exp + ":" + this.sign(cid, pid, grants, exp)
+}
+
+// Authenticate verifies the signature and the expiry of the token.
+func (this *HMACAuthenticator) Authenticate(cid string, token string, request *http.Request) (*Identity, error) {
+	if token == "" {
+		return nil, errors.New("no token")
+	}
+	if strings.Contains(cid, ":") {
+		return nil, errors.New("invalid cid")
+	}
+	grantsIdx := strings.Index(token, ":")
+	if grantsIdx <= 0 {
+		return nil, errors.New("invalid token")
+	}
+	sigIdx := strings.LastIndex(token, ":")
+	expIdx := strings.LastIndex(token[:sigIdx], ":")
+	if expIdx <= grantsIdx {
+		return nil, errors.New("invalid token")
+	}
+	pid := token[:grantsIdx]
+	grantsText := token[grantsIdx+1 : expIdx]
+	exp := token[expIdx+1 : sigIdx]
+	signature := token[sigIdx+1:]
+
+	if !hmac.Equal([]byte(signature), []byte(this.sign(cid, pid, grantsText, exp))) {
+		return nil, errors.New("invalid token")
+	}
+	grants, err := ParseGrants(grantsText)
+	if err != nil {
+		return nil, err
+	}
+	expUnix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid token")
+	}
+	expires := time.Unix(expUnix, 0)
+	if time.Now().After(expires) {
+		return nil, errors.New("token expired")
+	}
+	return &Identity{PID: pid, CID: cid, Expires: expires, Grants: grants}, nil
+}
+
+func (this *HMACAuthenticator) sign(cid string, pid string, grants string, exp string) string {
+	mac := hmac.New(sha256.New, this.Secret)
+	mac.Write([]byte(cid + ":" + pid + ":" + grants + ":" + exp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,93 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"saassoft.net/signaldistribution/base"
+	"testing"
+	"time"
+)
+
+func TestIdentityWithoutGrantsIsBoundToItsChannel(t *testing.T) {
+	authenticator := &HMACAuthenticator{Secret: []byte("secret")}
+	token := authenticator.NewToken("room.a", "p1", "", time.Now().Add(time.Hour))
+	identity, err := authenticator.Authenticate("room.a", token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !identity.Can("room.a", base.PERMISSION_PUBLISH) || !identity.Can("room.a", base.PERMISSION_SUBSCRIBE) {
+		t.Fatal("identity can not use the channel of its token")
+	}
+	if identity.Can("room.b", base.PERMISSION_PUBLISH) || identity.Can("room.b", base.PERMISSION_SUBSCRIBE) {
+		t.Fatal("identity without grants can use another channel")
+	}
+}
+
+func TestIdentityWithWildcardGrant(t *testing.T) {
+	authenticator := &HMACAuthenticator{Secret: []byte("secret")}
+	token := authenticator.NewToken("room.a", "p1", "sub@>", time.Now().Add(time.Hour))
+	identity, err := authenticator.Authenticate("room.a", token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !identity.Can("room.b", base.PERMISSION_SUBSCRIBE) {
+		t.Fatal("wildcard grant does not allow another channel")
+	}
+	if identity.Can("room.b", base.PERMISSION_PUBLISH) {
+		t.Fatal("sub grant allows publishing")
+	}
+}
+
+func TestAnonymousIdentityCanUseEveryChannel(t *testing.T) {
+	identity, err := (&AnonymousAuthenticator{}).Authenticate("room.a", "p1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !identity.Can("room.b", base.PERMISSION_PUBLISH) || !identity.Can("site.x.y", base.PERMISSION_SUBSCRIBE) {
+		t.Fatal("anonymous identity is limited")
+	}
+}
+
+func TestTokenIsRejected(t *testing.T) {
+	authenticator := &HMACAuthenticator{Secret: []byte("secret")}
+	valid := authenticator.NewToken("room.a", "p1", "", time.Now().Add(time.Hour))
+	other := &HMACAuthenticator{Secret: []byte("other")}
+	for name, test := range map[string]struct{ cid, token string }{
+		"bad signature": {"room.a", other.NewToken("room.a", "p1", "", time.Now().Add(time.Hour))},
+		"expired":       {"room.a", authenticator.NewToken("room.a", "p1", "", time.Now().Add(-time.Second))},
+		"other cid":     {"room.b", valid},
+		"malformed":     {"room.a", "p1:sig"},
+	} {
+		if _, err := authenticator.Authenticate(test.cid, test.token, nil); err == nil {
+			t.Error("token accepted:", name)
+		}
+	}
+}
+
+// TestTokenFieldsCanNotBeShifted issues a token for a pid with ":", it can not be turned into a token of another cid
+// by moving the part of the pid before ":" into the cid.
+func TestTokenFieldsCanNotBeShifted(t *testing.T) {
+	authenticator := &HMACAuthenticator{Secret: []byte("secret")}
+	token := authenticator.NewToken("a", "b:c", "", time.Now().Add(time.Hour))
+	if identity, err := authenticator.Authenticate("a:b", token[len("b:"):], nil); err == nil {
+		t.Fatal("forged token accepted for", identity.CID, identity.PID)
+	}
+	if _, err := authenticator.Authenticate("a", token, nil); err == nil {
+		t.Fatal("token with \":\" in pid accepted")
+	}
+}
+
+func TestIdentityCanSubscribeCoveredPattern(t *testing.T) {
+	identity := &Identity{PID: "p1", CID: "lobby", Grants: []Grant{{Pattern: "room.a.*", Permission: base.PERMISSION_SUBSCRIBE}}}
+	if !identity.Can("room.a.*", base.PERMISSION_SUBSCRIBE) {
+		t.Fatal("grant does not allow the same pattern")
+	}
+	for _, pattern := range []string{"room.a.>", "room.*.x", "room.>", "*.a.*"} {
+		if identity.Can(pattern, base.PERMISSION_SUBSCRIBE) {
+			t.Fatal("grant allows a wider pattern:", pattern)
+		}
+	}
+	if (&Identity{PID: "p1", CID: "lobby"}).Can("lobby.>", base.PERMISSION_SUBSCRIBE) {
+		t.Fatal("identity without grants can subscribe to a pattern")
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"errors"
+	"saassoft.net/signaldistribution/base"
+)
+
+// Capacity returns the count of clients and channels of the station and the limits of them.
+func (this *Station) Capacity() base.Capacity {
+	return base.Capacity{
+		Clients:     this.ClientCount(),
+		MaxClients:  this.MaxClients,
+		Channels:    this.ChannelCount(),
+		MaxChannels: this.MaxChannels,
+	}
+}
+
+// admitClient checks the channel can accept a new client, MaxClients of the station is checked when the client is added.
+func (this *Station) admitClient(cid string) error {
+	this.channelsLocker.RLock()
+	defer this.channelsLocker.RUnlock()
+	return this.admit(cid)
+}
+
+// admit checks the client can join in the channel, a new channel is opened only if the station has less than MaxChannels,
+// an existing channel accepts the client only if it has less than MaxChannelSize, counting the clients being resumed.
+// channelsLocker must be held.
+func (this *Station) admit(cid string) error {
+	channel := this.channels[cid]
+	if channel == nil {
+		if this.MaxChannels > 0 && len(this.channels) >= this.MaxChannels {
+			return errors.New(base.ERROR_MAXCHANNELS)
+		}
+		return nil
+	}
+	if this.MaxChannelSize > 0 && channel.admittedCount() >= this.MaxChannelSize {
+		return errors.New(base.ERROR_CHANNELFULL)
+	}
+	return nil
+}
@@ -3,85 +3,234 @@
 package signal
 
 import (
+	"errors"
+	"saassoft.net/signaldistribution/base"
 	"sync"
+	"time"
 )
 
 // Channel is the channel for transmitting the signals.
+// The clients of the channel are guarded by clientsLocker, they can be accessed from any goroutine.
 type Channel struct {
 	CID                    string
 	Station                *Station
+	History                *History
 	BeforeBroadcastHandler func(*Channel, *SignalPack) bool
 	AfterBroadcastHandler  func(*Channel, *SignalPack) bool
 	closeSign              chan bool
 	isClosed               bool
 	closeLock              sync.Mutex
 	clients                map[string]*Client
+	joinTimes              map[string]time.Time
+	clientsLocker          sync.RWMutex
+	resuming               int // count of clients admitted and being resumed, guarded by clientsLocker
 	broadcast              chan *SignalPack
+	resumes                chan *resumeRequest
+	redirects              chan chan bool
+	limiter                *Limiter
+}
+
+// resumePoint is the last signal that a reconnecting client received in a channel,
+// by sequence with the SeqSID of the signal, or by id.
+type resumePoint struct {
+	Seq uint64
+	SID string
+	ID  string
+}
+
+// resumeRequest asks the channel to add the client and to replay the signals after the resume point to it.
+type resumeRequest struct {
+	client *Client
+	from   resumePoint
+	done   chan *resumeResult
+}
+
+// resumeResult is the signals to replay before the client is added, or joined if the client has been added.
+// ok is false if the history does not keep all of the signals after the resume point.
+type resumeResult struct {
+	ok      bool
+	joined  bool
+	signals []*SignalPack
 }
 
 // Init sets up the channel.
 func (this *Channel) Init() {
 	this.closeSign = make(chan bool)
 	this.clients = make(map[string]*Client)
+	this.joinTimes = make(map[string]time.Time)
 	this.broadcast = make(chan *SignalPack)
+	this.resumes = make(chan *resumeRequest)
+	this.redirects = make(chan chan bool)
 }
 
-// Init sets up the channel with cid and station.
-func (this *Channel) InitWith(cid string, station *Station) {
+// Init sets up the channel with cid and station, the history keeps the sequence and the latest signals of the channel.
+func (this *Channel) InitWith(cid string, station *Station, history *History) {
 	this.Init()
 	this.CID = cid
 	this.Station = station
+	this.History = history
+	this.limiter = NewLimiter(station.ChannelLimit)
 }
 
 // Run makes the channel start to listen the signals, once the channel has received a signal,
 // relays the signal to other stations relay-connected with the station and sends the signal to the clients listening the channel,
 // if there are recorders, the channel records the signal to the recorders also.
+// The clients those subscribed to a pattern matching the channel receive the signal too.
+// A unicast signal is sent to the target client only, it is relayed only if the target is not in the station.
+//
+// Signals are handled one by one in the order they are broadcasted, and are numbered with the sequence of the channel,
+// so every participant receives them in the same order. Resuming clients are added between two signals,
+// so they receive the replayed signals and then the live signals without loss.
 func (this *Channel) Run() {
 	for {
 		select {
 		case signal := <-this.broadcast:
-			go this.Station.RecordSignal(signal)
-			go this.Station.RelayToRemoteStations(signal)
-			go this.sendToClients(signal)
-		case closed := <-this.closeSign:
-			if closed == true {
-				this.release()
-				return
+			if signal.Signal.IsExpired() {
+				continue
+			}
+			if signal.Signal.To != "" {
+				this.sendToTarget(signal)
+				continue
+			}
+			if !this.Station.mergeState(signal) {
+				continue
 			}
+			signal.Signal.SeqSID = this.seqSID()
+			this.History.Append(signal)
+			this.Station.retain(signal)
+			this.Station.RecordSignal(signal)
+			this.Station.RelayToRemoteStations(signal)
+			this.sendToClients(signal)
+		case request := <-this.resumes:
+			request.done <- this.resume(request.client, request.from)
+		case done := <-this.redirects:
+			for _, client := range this.Clients() {
+				client.redirect()
+			}
+			close(done)
+		case <-this.closeSign:
+			return
 		}
 	}
 }
 
 // ClientCount returns the count of clients connected.
 func (this *Channel) ClientCount() int {
+	this.clientsLocker.RLock()
+	defer this.clientsLocker.RUnlock()
 	return len(this.clients)
 }
 
+// admittedCount returns the count of clients in the channel and of those admitted and being resumed,
+// they all count against MaxChannelSize.
+func (this *Channel) admittedCount() int {
+	this.clientsLocker.RLock()
+	defer this.clientsLocker.RUnlock()
+	return len(this.clients) + this.resuming
+}
+
+// admitResuming counts the client admitted to resume in the channel, until resumed is called,
+// so the clients resuming at once do not exceed MaxChannelSize.
+func (this *Channel) admitResuming() {
+	this.clientsLocker.Lock()
+	defer this.clientsLocker.Unlock()
+	this.resuming++
+}
+
+// resumed stops counting the client admitted to resume, it is in the channel or failed to resume.
+func (this *Channel) resumed() {
+	this.clientsLocker.Lock()
+	defer this.clientsLocker.Unlock()
+	this.resuming--
+}
+
 // ClientJoin sets up the client that joins in the channel.
 func (this *Channel) ClientJoin(client *Client) {
+	this.clientsLocker.Lock()
+	defer this.clientsLocker.Unlock()
 	this.clients[client.Info.UPID] = client
+	this.joinTimes[client.Info.UPID] = time.Now()
 }
 
 // ClientQuit deletes the client when it quits the channel.
 func (this *Channel) ClientQuit(client *Client) {
-	this.clients[client.Info.UPID] = nil
+	this.clientsLocker.Lock()
+	defer this.clientsLocker.Unlock()
 	delete(this.clients, client.Info.UPID)
+	delete(this.joinTimes, client.Info.UPID)
 }
 
 // GetClientByUPID returns the client with the upid in the channel.
 func (this *Channel) GetClientByUPID(upid string) *Client {
+	this.clientsLocker.RLock()
+	defer this.clientsLocker.RUnlock()
 	return this.clients[upid]
 }
 
-// Clients returns the clients in the channel.
+// Clients returns a copy of the clients in the channel.
 func (this *Channel) Clients() map[string]*Client {
-	return this.clients
+	this.clientsLocker.RLock()
+	defer this.clientsLocker.RUnlock()
+	clients := make(map[string]*Client, len(this.clients))
+	for upid, client := range this.clients {
+		clients[upid] = client
+	}
+	return clients
+}
+
+// Presence returns the presence of the client in the channel, or nil if the client is not in the channel.
+func (this *Channel) Presence(upid string) *base.Presence {
+	this.clientsLocker.RLock()
+	defer this.clientsLocker.RUnlock()
+	return this.presence(upid)
+}
+
+// Presences returns the presences of the clients in the channel.
+func (this *Channel) Presences() []*base.Presence {
+	this.clientsLocker.RLock()
+	defer this.clientsLocker.RUnlock()
+	presences := []*base.Presence{}
+	for upid, _ := range this.clients {
+		presences = append(presences, this.presence(upid))
+	}
+	return presences
+}
+
+// Resume adds the client to the channel, and replays the signals after the resume point to it before the live signals.
+// The signals are replayed in batches as the client sends them, the client is added once no signal is left to replay,
+// so no replayed signal is dropped by the overflow policy.
+// It returns false without adding the client if the history does not keep all of those signals,
+// it returns an error if the channel or the client is closed.
+func (this *Channel) Resume(client *Client, from resumePoint) (bool, error) {
+	for {
+		request := &resumeRequest{client: client, from: from, done: make(chan *resumeResult, 1)}
+		select {
+		case this.resumes <- request:
+		case <-this.closeSign:
+			return false, errors.New("channel is closed")
+		}
+		result := <-request.done
+		if !result.ok || result.joined {
+			return result.ok, nil
+		}
+		for _, signal := range result.signals {
+			if err := client.replaySignal(signal); err != nil {
+				return false, err
+			}
+		}
+		last := result.signals[len(result.signals)-1].Signal
+		from = resumePoint{Seq: last.Seq, SID: last.SeqSID}
+	}
 }
 
-// Broadcast broadcasts the signal to the channel.
+// Broadcast broadcasts the signal to the channel. The signal is discarded if the channel is closed.
 func (this *Channel) Broadcast(signal *SignalPack) error {
 	if this.BeforeBroadcastHandler == nil || this.BeforeBroadcastHandler(this, signal) {
-		this.broadcast <- signal
+		select {
+		case this.broadcast <- signal:
+		case <-this.closeSign:
+			return nil
+		}
 		if this.AfterBroadcastHandler != nil {
 			this.AfterBroadcastHandler(this, signal)
 		}
@@ -89,6 +238,21 @@ func (this *Channel) Broadcast(signal *SignalPack) error {
 	return nil
 }
 
+// Redirect asks the clients of the channel to reconnect to another station, after the signals broadcasted before,
+// it returns when the redirect is pushed to them.
+func (this *Channel) Redirect() {
+	done := make(chan bool)
+	select {
+	case this.redirects <- done:
+	case <-this.closeSign:
+		return
+	}
+	select {
+	case <-done:
+	case <-this.closeSign:
+	}
+}
+
 // Close closes the channel,clean the resources of the channel.
 func (this *Channel) Close() {
 	this.closeLock.Lock()
@@ -97,16 +261,77 @@ func (this *Channel) Close() {
 		return
 	}
 	this.isClosed = true
-	this.closeSign <- true
+	close(this.closeSign)
+}
+
+// resume adds the client if no signal is after the resume point, otherwise returns the first batch of them.
+func (this *Channel) resume(client *Client, from resumePoint) *resumeResult {
+	var signals []*SignalPack
+	var ok bool
+	if from.ID != "" {
+		signals, ok = this.History.SinceID(from.ID)
+	} else if from.SID == this.seqSID() {
+		signals, ok = this.History.SinceSeq(from.Seq)
+	}
+	if !ok {
+		return &resumeResult{}
+	}
+	if !client.Identity.Can(this.CID, base.PERMISSION_SUBSCRIBE) {
+		signals = nil
+	}
+	if len(signals) > 0 {
+		if size := cap(client.Info.Signals); len(signals) > size {
+			signals = signals[:size]
+		}
+		return &resumeResult{ok: true, signals: signals}
+	}
+	this.ClientJoin(client)
+	return &resumeResult{ok: true, joined: true}
+}
+
+// seqSID identifies the sequence of the channel by the sid of the station and the epoch of the history.
+func (this *Channel) seqSID() string {
+	return this.Station.Info.SID + "-" + this.History.Epoch()
+}
+
+func (this *Channel) presence(upid string) *base.Presence {
+	client := this.clients[upid]
+	if client == nil {
+		return nil
+	}
+	return &base.Presence{
+		CID:  this.CID,
+		PID:  client.Info.PID,
+		UPID: upid,
+		SID:  this.Station.Info.SID,
+		Time: this.joinTimes[upid],
+	}
 }
 
 func (this *Channel) sendToClients(signal *SignalPack) {
-	for _, client := range this.clients {
-		client.PushSignal(signal)
+	for _, client := range this.Clients() {
+		if client.Identity.Can(this.CID, base.PERMISSION_SUBSCRIBE) {
+			client.PushSignal(signal)
+		}
 	}
+	this.Station.sendToSubscribers(signal)
 }
 
-func (this *Channel) release() {
-	close(this.broadcast)
-	close(this.closeSign)
+func (this *Channel) sendToTarget(signal *SignalPack) {
+	delivered := false
+	for _, client := range this.Clients() {
+		if client.Info.PID != signal.Signal.To && client.Info.UPID != signal.Signal.To {
+			continue
+		}
+		delivered = true
+		if client.Identity.Can(this.CID, base.PERMISSION_SUBSCRIBE) {
+			client.PushSignal(signal)
+		}
+	}
+	if this.Station.sendToSubscribers(signal) {
+		delivered = true
+	}
+	if !delivered {
+		this.Station.RelayToRemoteStations(signal)
+	}
 }
@@ -5,62 +5,227 @@ package signal
 import (
 	"code.google.com/p/go-uuid/uuid"
 	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"errors"
 	"log"
 	"saassoft.net/signaldistribution/base"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Client represents an end-client is connecting to a channel, it is kind of participant.
+// Client represents an end-client is connecting to a station, it is kind of participant.
+// A client can join in many channels over one connection,
+// CID is the channel that the client joined in when it connected, signals without cid are broadcasted to it.
+// A client can subscribe to channel patterns also, then it receives the signals of every matching channel.
+// The channels and the patterns are guarded by channelsLocker,
+// as the station looks them up while sending signals and removes them when the client is kicked.
+//
+// A reliable client acknowledges the signals it received by the ack command, the signals not acknowledged in time are redelivered,
+// and those left when it quits are redelivered when it joins in the channel again.
+// A reliable client may set the id of the signals it publishes, the station drops a signal with a published id,
+// and acknowledges every published signal with an ack signal.
+//
+// A client sends a request signal and waits for the reply, the requester receives a timeout error if nobody replies in time,
+// the replies after the timeout are dropped.
+//
+// A client joined with binary=1 receives the signals in binary frames, others receive them in JSON text frames.
+// Either client may send signals in both kinds of frame.
+//
+// The station sends blank signals as heartbeats, and the client should send blank signals when it is idle,
+// or it is disconnected on the read timeout of the heartbeat.
+// A client sending a frame over the max frame size, or violating its rate limit too many times, is disconnected.
 type Client struct {
-	Info    ParticipantStruct
-	Channel *Channel
+	Info           ParticipantStruct
+	Station        *Station
+	CID            string
+	Identity       *Identity
+	token          string
+	Reliable       bool
+	Binary         bool
+	limiter        *Limiter
+	violations     int64
+	unacked        Unacked
+	requests       Requests
+	channels       map[string]*Channel
+	channelsLocker sync.RWMutex
+	patterns       map[string]bool
+	redirected     int32
 }
 
 // StartBroadcast starts to wait for producing signals, once a new signal is produced,
 // the client broadcasts the signal to the station.
+// Command signals are handled by the station instead of being broadcasted.
 func (this *Client) StartBroadcast() {
 	for {
 		var signal Signal
-		if err := websocket.JSON.Receive(this.Info.Remote.Conn, &signal); err != nil {
+		this.Station.Heartbeat.SetReadDeadline(this.Info.Remote.Conn)
+		if err := this.Station.clientReceive(this.Info.Remote.Conn, &signal); err != nil {
+			if err == errFrameTooLarge {
+				atomic.AddInt64(&this.Station.violations.Frame, 1)
+				atomic.AddInt64(&this.violations, 1)
+				log.Println("station - client: frame too large:", this.Info.PID)
+			}
 			return
 		}
 		if signal.Type == base.SIGNALTYPE_BLANK {
 			continue
 		}
-		signal.ID = uuid.New()
+		if signal.CID == "" {
+			signal.CID = this.CID
+		}
+		if signal.Type == base.SIGNALTYPE_CMD {
+			// commands are limited by the client and the station limits, as they cost as much as signals
+			if !this.Station.allowSignal(this, nil, &signal) {
+				if this.isViolating() {
+					return
+				}
+				continue
+			}
+			if err := this.Station.handleClientCmd(this, signal.Text); err != nil {
+				this.pushError(signal.CID, err.Error())
+			}
+			continue
+		}
+		if isSystemSignal(&signal) {
+			this.pushError(signal.CID, "signal type is reserved for the station")
+			continue
+		}
+		if this.Station.IsDraining() {
+			this.pushError(signal.CID, base.ERROR_SHUTTINGDOWN)
+			continue
+		}
+		if !this.InChannel(signal.CID) {
+			this.pushError(signal.CID, "not in channel")
+			continue
+		}
+		if !this.Identity.Can(signal.CID, base.PERMISSION_PUBLISH) {
+			this.pushError(signal.CID, "no permission to publish")
+			continue
+		}
+		if this.Station.isMuted(signal.CID, this) {
+			this.pushError(signal.CID, base.ERROR_MUTED)
+			continue
+		}
+		if !this.Station.allowSignal(this, this.Channel(signal.CID), &signal) {
+			if this.isViolating() {
+				return
+			}
+			continue
+		}
+		if signal.Retain && !isRetainable(&signal) {
+			this.pushError(signal.CID, "retained signal too large")
+			continue
+		}
+		reliable := this.IsReliable(signal.CID)
+		publishedID := signal.ID
+		if reliable && publishedID != "" {
+			signal.ID = this.Info.PID + "-" + publishedID
+			if this.Station.isPublished(signal.ID) {
+				this.pushAck(signal.CID, publishedID)
+				continue
+			}
+		} else {
+			signal.ID = uuid.New()
+			publishedID = signal.ID
+		}
 		signal.PID = this.Info.PID
+		this.setSystemHeaders(&signal)
+		signal.ExpireTime = time.Time{}
+		if signal.TTL > 0 {
+			signal.ExpireTime = time.Now().Add(time.Duration(signal.TTL) * time.Millisecond)
+		}
+		if err := this.prepareRPC(&signal); err != nil {
+			this.pushError(signal.CID, err.Error())
+			continue
+		}
 		signalPack := SignalPack{
 			Signal:   signal,
-			CID:      this.Channel.CID,
+			CID:      signal.CID,
 			Time:     time.Now(),
 			Stations: []string{},
 		}
 		log.Println("station - client: new signal:", signal.Text)
-		this.Relay(&signalPack)
+		signals, err := this.Station.intercept(&signalPack)
+		if err != nil {
+			this.pushError(signal.CID, err.Error())
+			continue
+		}
+		for _, intercepted := range signals {
+			if intercepted == &signalPack {
+				this.Relay(intercepted)
+			} else {
+				this.Station.publish(intercepted)
+			}
+		}
+		if reliable {
+			this.pushAck(signal.CID, publishedID)
+		}
 	}
 }
 
 // StartListen starts to listen the station, once a signal is received, sends the signal to the client.
+// The signal sent is marked with the cid of the channel it came from.
 func (this *Client) StartListen() {
-	for b := range this.Info.Signals {
-		if b == nil {
+	for {
+		b, ok := this.Info.Pop()
+		if !ok {
 			return
 		}
-		err := websocket.JSON.Send(this.Info.Remote.Conn, b.Signal)
+		signal := b.Signal
+		signal.CID = b.CID
+		if signal.Type == base.SIGNALTYPE_REPLY && !this.requests.End(signal.CorrelationID) {
+			continue
+		}
+		err := this.codec().Send(this.Info.Remote.Conn, signal)
 		if err != nil {
+			this.Info.Close()
 			break
 		}
+		if signal.Type == base.SIGNALTYPE_SIGNAL && this.IsReliable(b.CID) {
+			this.unacked.Sent(b)
+		}
 	}
 }
 
-// Relay relays a signal to the channel listening to.
+// Relay relays a signal to the channel that the signal belongs to.
 func (this *Client) Relay(signal *SignalPack) error {
-	return this.Channel.Broadcast(signal)
+	channel := this.Channel(signal.CID)
+	if channel == nil {
+		return nil
+	}
+	return channel.Broadcast(signal)
 }
 
-// PushSignal pushes a signal to the client.
+// PushSignal pushes a signal to the client, the signal of a reliable channel is kept until the client acknowledges it.
 func (this *Client) PushSignal(signal *SignalPack) error {
-	this.Info.Signals <- signal
+	if err := this.keepUnacked(signal); err != nil {
+		return err
+	}
+	return this.Info.Push(signal)
+}
+
+// replaySignal pushes a signal replayed from the history or the recorders, it waits for room in the queue whatever the overflow policy is.
+func (this *Client) replaySignal(signal *SignalPack) error {
+	if err := this.keepUnacked(signal); err != nil {
+		return err
+	}
+	return this.Info.PushWait(signal)
+}
+
+// keepUnacked keeps the signal of a reliable channel until the client acknowledges it.
+// A client with MaxUnacked signals unacknowledged is disconnected, the signals are redelivered when it reconnects,
+// and those after them are resumed from the history.
+func (this *Client) keepUnacked(signal *SignalPack) error {
+	if signal.Signal.Type != base.SIGNALTYPE_SIGNAL || !this.IsReliable(signal.CID) {
+		return nil
+	}
+	if !this.unacked.Queued(signal) {
+		log.Println("station - client: too many unacked signals:", this.Info.PID)
+		this.Info.Close()
+		return errors.New("too many unacked signals")
+	}
 	return nil
 }
 
@@ -71,8 +236,218 @@ func (this *Client) PushSignals(signals []*SignalPack) {
 	}
 }
 
+// Channels returns the channels that the client joined in.
+func (this *Client) Channels() []*Channel {
+	this.channelsLocker.RLock()
+	defer this.channelsLocker.RUnlock()
+	channels := []*Channel{}
+	for _, channel := range this.channels {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// InChannel returns true if the client joined in the channel.
+func (this *Client) InChannel(cid string) bool {
+	return this.Channel(cid) != nil
+}
+
+// Channel returns the channel with the cid that the client joined in, or nil if the client is not in it.
+func (this *Client) Channel(cid string) *Channel {
+	this.channelsLocker.RLock()
+	defer this.channelsLocker.RUnlock()
+	return this.channels[cid]
+}
+
+// Patterns returns the channel patterns that the client subscribed to.
+func (this *Client) Patterns() []string {
+	this.channelsLocker.RLock()
+	defer this.channelsLocker.RUnlock()
+	patterns := []string{}
+	for pattern, _ := range this.patterns {
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// hasPattern returns true if the client subscribed to the pattern.
+func (this *Client) hasPattern(pattern string) bool {
+	this.channelsLocker.RLock()
+	defer this.channelsLocker.RUnlock()
+	return this.patterns[pattern]
+}
+
+// setPattern records the pattern as subscribed, or removes it.
+func (this *Client) setPattern(pattern string, subscribed bool) {
+	this.channelsLocker.Lock()
+	defer this.channelsLocker.Unlock()
+	if subscribed {
+		this.patterns[pattern] = true
+	} else {
+		delete(this.patterns, pattern)
+	}
+}
+
+// IsReliable returns true if the signals of the channel are delivered to the client at least once.
+func (this *Client) IsReliable(cid string) bool {
+	return this.Reliable || this.Station.IsReliableChannel(cid)
+}
+
+// Ack acknowledges the signal with the id, it returns false if the signal is not waiting for ack.
+func (this *Client) Ack(id string) bool {
+	return this.unacked.Ack(id)
+}
+
+// ViolationCount returns the count of limit violations of the client.
+func (this *Client) ViolationCount() int64 {
+	return atomic.LoadInt64(&this.violations)
+}
+
 // Close closes the client,and release the resources of the client.
 func (this *Client) Close() {
-	close(this.Info.Signals)
-	_ = this.Info.Remote.Conn.Close()
+	this.requests.Close()
+	this.Info.Close()
+}
+
+// IP returns the ip address of the client.
+func (this *Client) IP() string {
+	return hostOf(this.Info.Remote.IpAddr)
+}
+
+// setSystemHeaders replaces the system headers set by the client with those of the station.
+func (this *Client) setSystemHeaders(signal *Signal) {
+	headers := make(map[string]string, len(signal.Headers)+2)
+	for name, value := range signal.Headers {
+		if !strings.HasPrefix(name, base.HEADER_SYSTEM_PREFIX) {
+			headers[name] = value
+		}
+	}
+	headers[base.HEADER_ORIGIN_SID] = this.Station.Info.SID
+	headers[base.HEADER_RECEIVE_TIME] = time.Now().Format(time.RFC3339Nano)
+	signal.Headers = headers
+}
+
+func (this *Client) codec() websocket.Codec {
+	if this.Binary {
+		return BinaryCodec
+	}
+	return JSONCodec
+}
+
+func (this *Client) pushError(cid string, text string) {
+	this.PushSignal(&SignalPack{
+		Signal:   *this.Station.newError(text),
+		CID:      cid,
+		Time:     time.Now(),
+		Stations: []string{},
+	})
+}
+
+// redirect asks the client to reconnect to another station, it is pushed once only.
+func (this *Client) redirect() {
+	if !atomic.CompareAndSwapInt32(&this.redirected, 0, 1) {
+		return
+	}
+	this.PushSignal(&SignalPack{
+		Signal:   Signal{Type: base.SIGNALTYPE_REDIRECT, Text: base.ERROR_SHUTTINGDOWN},
+		CID:      this.CID,
+		Time:     time.Now(),
+		Stations: []string{},
+	})
+}
+
+func (this *Client) pushPresences(cid string, presences []*base.Presence) error {
+	text, err := json.Marshal(presences)
+	if err != nil {
+		return err
+	}
+	this.PushSignal(&SignalPack{
+		Signal:   Signal{ID: uuid.New(), Type: base.SIGNALTYPE_PRESENCE, Text: string(text)},
+		CID:      cid,
+		Time:     time.Now(),
+		Stations: []string{},
+	})
+	return nil
+}
+
+func (this *Client) setChannel(channel *Channel) {
+	this.channelsLocker.Lock()
+	defer this.channelsLocker.Unlock()
+	this.channels[channel.CID] = channel
+}
+
+func (this *Client) removeChannel(cid string) {
+	this.channelsLocker.Lock()
+	defer this.channelsLocker.Unlock()
+	delete(this.channels, cid)
+}
+
+func (this *Client) redeliver() {
+	ticker := time.NewTicker(base.STATION_ACK_TIMEOUT)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			this.PushSignals(this.unacked.Expired(base.STATION_ACK_TIMEOUT))
+		case <-this.Info.closed:
+			return
+		}
+	}
+}
+
+func (this *Client) pushAck(cid string, id string) {
+	this.PushSignal(&SignalPack{
+		Signal:   Signal{Type: base.SIGNALTYPE_ACK, Text: id},
+		CID:      cid,
+		Time:     time.Now(),
+		Stations: []string{},
+	})
+}
+
+// isViolating returns true if the client is over its rate limit more than MaxViolations times, it is disconnected then.
+func (this *Client) isViolating() bool {
+	if max := this.Station.MaxViolations; max > 0 && this.ViolationCount() > int64(max) {
+		log.Println("station - client: too many violations:", this.Info.PID)
+		return true
+	}
+	return false
+}
+
+// isSystemSignal returns true if the signal is of a type that only the station creates, clients can not publish it.
+func isSystemSignal(signal *Signal) bool {
+	switch signal.Type {
+	case base.SIGNALTYPE_PJOIN, base.SIGNALTYPE_PQUIT, base.SIGNALTYPE_ERROR, base.SIGNALTYPE_PRESENCE,
+		base.SIGNALTYPE_ACK, base.SIGNALTYPE_REDIRECT, base.SIGNALTYPE_STATE:
+		return true
+	}
+	return false
+}
+
+// prepareRPC sets up the request signal to wait for the reply, and routes the reply signal to the requester.
+func (this *Client) prepareRPC(signal *Signal) error {
+	switch signal.Type {
+	case base.SIGNALTYPE_REQUEST:
+		signal.ReplyTo = this.Info.UPID
+		if signal.CorrelationID == "" {
+			signal.CorrelationID = signal.ID
+		}
+		cid, correlationID := signal.CID, signal.CorrelationID
+		this.requests.Start(correlationID, this.Station.RequestTimeout, func() {
+			this.PushSignal(&SignalPack{
+				Signal:   Signal{Type: base.SIGNALTYPE_ERROR, Text: base.ERROR_TIMEOUT, CorrelationID: correlationID},
+				CID:      cid,
+				Time:     time.Now(),
+				Stations: []string{},
+			})
+		})
+	case base.SIGNALTYPE_REPLY:
+		if signal.To == "" {
+			signal.To = signal.ReplyTo
+		}
+		if signal.To == "" || signal.CorrelationID == "" {
+			return errors.New("no reply-to or correlation id")
+		}
+		signal.ReplyTo = ""
+	}
+	return nil
 }
@@ -0,0 +1,136 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"errors"
+	"saassoft.net/signaldistribution/base"
+	"strings"
+)
+
+func (this *Station) registerClientCmdHandlers() {
+	this.clientCmdHandlers = make(map[string]func(*Client, string) error)
+	this.clientCmdHandlers[base.CLIENTCMD_SUBSCRIBE] = this.clientCmdHandler_Subscribe
+	this.clientCmdHandlers[base.CLIENTCMD_UNSUBSCRIBE] = this.clientCmdHandler_Unsubscribe
+	this.clientCmdHandlers[base.CLIENTCMD_PRESENCE] = this.clientCmdHandler_Presence
+	this.clientCmdHandlers[base.CLIENTCMD_CLUSTERPRESENCE] = this.clientCmdHandler_ClusterPresence
+	this.clientCmdHandlers[base.CLIENTCMD_ACK] = this.clientCmdHandler_Ack
+	this.clientCmdHandlers[base.CLIENTCMD_SET] = this.clientCmdHandler_Set
+	this.clientCmdHandlers[base.CLIENTCMD_DELETE] = this.clientCmdHandler_Delete
+}
+
+func (this *Station) handleClientCmd(client *Client, cmdText string) error {
+	cmd, arg := cmdText, ""
+	if idx := strings.Index(cmdText, ":"); idx >= 0 {
+		cmd, arg = cmdText[:idx], cmdText[idx+1:]
+	}
+	handler := this.clientCmdHandlers[cmd]
+	if handler == nil {
+		return errors.New("unknown cmd: " + cmd)
+	}
+	return handler(client, arg)
+}
+
+func (this *Station) clientCmdHandler_Subscribe(client *Client, cid string) error {
+	if cid == "" {
+		return errors.New("no cid")
+	}
+	if base.IsChannelPattern(cid) {
+		if client.hasPattern(cid) {
+			return nil
+		}
+		// the bans of single channels are checked when the signals are sent to the subscribers
+		if !client.Identity.Can(cid, base.PERMISSION_SUBSCRIBE) {
+			return errors.New("no permission on channel")
+		}
+		if this.isBanned(cid, client) {
+			return errors.New(base.ERROR_BANNED)
+		}
+		this.subscribePattern(client, cid)
+		return nil
+	}
+	if client.InChannel(cid) {
+		return nil
+	}
+	if !client.Identity.Can(cid, base.PERMISSION_PUBLISH) && !client.Identity.Can(cid, base.PERMISSION_SUBSCRIBE) {
+		return errors.New("no permission on channel")
+	}
+	if this.isBanned(cid, client) {
+		return errors.New(base.ERROR_BANNED)
+	}
+	return this.joinChannel(client, cid)
+}
+
+func (this *Station) clientCmdHandler_Unsubscribe(client *Client, cid string) error {
+	if base.IsChannelPattern(cid) {
+		if !client.hasPattern(cid) {
+			return errors.New("not subscribed")
+		}
+		this.unsubscribePattern(client, cid)
+		return nil
+	}
+	channel := client.Channel(cid)
+	if channel == nil {
+		return errors.New("not in channel")
+	}
+	this.leaveChannel(client, channel)
+	return nil
+}
+
+func (this *Station) clientCmdHandler_Presence(client *Client, cid string) error {
+	if cid == "" {
+		cid = client.CID
+	}
+	if !client.Identity.Can(cid, base.PERMISSION_SUBSCRIBE) {
+		return errors.New("no permission to subscribe")
+	}
+	return client.pushPresences(cid, this.Presences(cid))
+}
+
+func (this *Station) clientCmdHandler_ClusterPresence(client *Client, cid string) error {
+	if cid == "" {
+		cid = client.CID
+	}
+	if !client.Identity.Can(cid, base.PERMISSION_SUBSCRIBE) {
+		return errors.New("no permission to subscribe")
+	}
+	presences, err := this.ClusterPresences(cid, client.Identity.CID, client.token)
+	if err != nil {
+		return err
+	}
+	return client.pushPresences(cid, presences)
+}
+
+func (this *Station) clientCmdHandler_Ack(client *Client, ids string) error {
+	for _, id := range strings.Split(ids, ",") {
+		if id != "" {
+			client.Ack(id)
+		}
+	}
+	return nil
+}
+
+func (this *Station) clientCmdHandler_Set(client *Client, arg string) error {
+	cid, entry := splitStateArg(client, arg)
+	idx := strings.Index(entry, "=")
+	if idx < 0 {
+		return errors.New("no value")
+	}
+	return this.setState(client, cid, entry[:idx], entry[idx+1:], false)
+}
+
+func (this *Station) clientCmdHandler_Delete(client *Client, arg string) error {
+	cid, key := splitStateArg(client, arg)
+	return this.setState(client, cid, key, "", true)
+}
+
+func splitStateArg(client *Client, arg string) (string, string) {
+	cid, rest := client.CID, arg
+	if idx := strings.Index(arg, ":"); idx >= 0 {
+		cid, rest = arg[:idx], arg[idx+1:]
+		if cid == "" {
+			cid = client.CID
+		}
+	}
+	return cid, rest
+}
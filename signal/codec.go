@@ -0,0 +1,131 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"saassoft.net/signaldistribution/base"
+)
+
+// BinaryCodec sends signals and signal packs in binary frames, the payload is carried as raw bytes.
+// A binary frame is the 4 bytes big-endian length of the header, the header in JSON without the payload, then the payload.
+// Other values are sent in JSON text frames.
+//
+// JSONCodec sends everything in JSON text frames, the payload is encoded in base64 by JSON.
+// Both codecs receive text frames and binary frames.
+var (
+	BinaryCodec = websocket.Codec{Marshal: marshalBinary, Unmarshal: unmarshalFrame}
+	JSONCodec   = websocket.Codec{Marshal: marshalJSON, Unmarshal: unmarshalFrame}
+)
+
+// NegotiateCodec returns BinaryCodec if both servers receive binary frames, otherwise JSONCodec,
+// so the links to the servers of older versions keep working while a cluster is upgraded.
+func NegotiateCodec(localInfo *base.ServerInfo, remoteInfo *base.ServerInfo) websocket.Codec {
+	if localInfo.Binary && remoteInfo.Binary {
+		return BinaryCodec
+	}
+	return JSONCodec
+}
+
+const frameHeaderLength = 4
+
+var errFrameTooLarge = errors.New("frame too large")
+
+// limitedReceive returns a receive function like JSONCodec.Receive that rejects the frames larger than maxFrameSize,
+// zero means no limit. The size is checked by the length in the frame header, before the payload is read.
+func limitedReceive(maxFrameSize int) func(*websocket.Conn, interface{}) error {
+	if maxFrameSize <= 0 {
+		return JSONCodec.Receive
+	}
+	return func(ws *websocket.Conn, v interface{}) error {
+		for {
+			frame, err := ws.NewFrameReader()
+			if err != nil {
+				return err
+			}
+			// control frames are handled here and return no frame
+			if frame, err = ws.HandleFrame(frame); err != nil {
+				return err
+			}
+			if frame == nil {
+				continue
+			}
+			if frame.Len() > maxFrameSize {
+				return errFrameTooLarge
+			}
+			data, err := ioutil.ReadAll(frame)
+			if err != nil {
+				return err
+			}
+			return unmarshalFrame(data, frame.PayloadType(), v)
+		}
+	}
+}
+
+func marshalJSON(v interface{}) ([]byte, byte, error) {
+	data, err := json.Marshal(v)
+	return data, websocket.TextFrame, err
+}
+
+func marshalBinary(v interface{}) ([]byte, byte, error) {
+	var payload []byte
+	switch signal := v.(type) {
+	case Signal:
+		payload, signal.Payload = signal.Payload, nil
+		v = &signal
+	case *Signal:
+		header := *signal
+		payload, header.Payload = header.Payload, nil
+		v = &header
+	case SignalPack:
+		payload, signal.Signal.Payload = signal.Signal.Payload, nil
+		v = &signal
+	case *SignalPack:
+		header := *signal
+		payload, header.Signal.Payload = header.Signal.Payload, nil
+		v = &header
+	default:
+		return marshalJSON(v)
+	}
+	header, err := json.Marshal(v)
+	if err != nil {
+		return nil, websocket.BinaryFrame, err
+	}
+	data := make([]byte, frameHeaderLength, frameHeaderLength+len(header)+len(payload))
+	binary.BigEndian.PutUint32(data, uint32(len(header)))
+	data = append(data, header...)
+	data = append(data, payload...)
+	return data, websocket.BinaryFrame, nil
+}
+
+func unmarshalFrame(data []byte, payloadType byte, v interface{}) error {
+	if payloadType != websocket.BinaryFrame {
+		return json.Unmarshal(data, v)
+	}
+	if len(data) < frameHeaderLength {
+		return errors.New("bad binary frame")
+	}
+	length := binary.BigEndian.Uint32(data)
+	if uint64(len(data)-frameHeaderLength) < uint64(length) {
+		return errors.New("bad binary frame")
+	}
+	end := frameHeaderLength + int(length)
+	if err := json.Unmarshal(data[frameHeaderLength:end], v); err != nil {
+		return err
+	}
+	if end == len(data) {
+		return nil
+	}
+	payload := data[end:]
+	switch signal := v.(type) {
+	case *Signal:
+		signal.Payload = payload
+	case *SignalPack:
+		signal.Signal.Payload = payload
+	}
+	return nil
+}
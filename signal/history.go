@@ -0,0 +1,97 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// History keeps the sequence and the latest signals of a channel in a ring buffer,
+// so reconnecting clients can resume from the last signal they received.
+// The station keeps the history for a while after the channel is closed, so the sequence continues when it is reopened.
+type History struct {
+	CID      string
+	epoch    string
+	usedTime time.Time
+	seq      uint64
+	signals  []*SignalPack
+	start    int
+	count    int
+	locker   sync.RWMutex
+}
+
+// NewHistory returns an empty history that keeps size signals at most.
+func NewHistory(cid string, size int) *History {
+	return &History{CID: cid, epoch: strconv.FormatInt(time.Now().UnixNano(), 36), usedTime: time.Now(), signals: make([]*SignalPack, size)}
+}
+
+// Epoch identifies the sequence of the history, a history created again numbers the signals from the start in another epoch.
+func (this *History) Epoch() string {
+	return this.epoch
+}
+
+// UsedTime returns the time of the last signal appended.
+func (this *History) UsedTime() time.Time {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+	return this.usedTime
+}
+
+// Append numbers the signal with the next sequence and keeps it.
+func (this *History) Append(signal *SignalPack) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	this.seq++
+	signal.Signal.Seq = this.seq
+	this.usedTime = time.Now()
+	if len(this.signals) == 0 {
+		return
+	}
+	if this.count < len(this.signals) {
+		this.signals[(this.start+this.count)%len(this.signals)] = signal
+		this.count++
+		return
+	}
+	this.signals[this.start] = signal
+	this.start = (this.start + 1) % len(this.signals)
+}
+
+// Seq returns the sequence of the last signal.
+func (this *History) Seq() uint64 {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+	return this.seq
+}
+
+// SinceSeq returns the signals after the signal with the sequence,
+// it returns false if some of those signals are not kept any more.
+func (this *History) SinceSeq(seq uint64) ([]*SignalPack, bool) {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+	if seq > this.seq || this.seq-seq > uint64(this.count) {
+		return nil, false
+	}
+	return this.last(int(this.seq - seq)), true
+}
+
+// SinceID returns the signals after the signal with the id, it returns false if the signal is not kept.
+func (this *History) SinceID(id string) ([]*SignalPack, bool) {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+	for i := this.count - 1; i >= 0; i-- {
+		if this.signals[(this.start+i)%len(this.signals)].Signal.ID == id {
+			return this.last(this.count - 1 - i), true
+		}
+	}
+	return nil, false
+}
+
+func (this *History) last(n int) []*SignalPack {
+	signals := make([]*SignalPack, 0, n)
+	for i := this.count - n; i < this.count; i++ {
+		signals = append(signals, this.signals[(this.start+i)%len(this.signals)])
+	}
+	return signals
+}
@@ -0,0 +1,112 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"errors"
+	"sync"
+)
+
+// Interceptor intercepts the signals published by the clients of the station before they are broadcasted,
+// the signals relayed from other stations have been intercepted there.
+// Intercept returns the signals to go on with: the signal itself or a modified copy of it to pass it,
+// none to reject it, or more signals to fork copies, e.g. to another channel by another CID.
+// The signal itself, or the first signal returned if the signal itself is not, goes on as the original with its id,
+// so reliable clients still dedupe it. The other signals with the id of the original are given new ids.
+// An error rejects the signal and is replied to the publisher.
+type Interceptor interface {
+	Intercept(station *Station, signal *SignalPack) ([]*SignalPack, error)
+}
+
+// InterceptorFunc is a func used as an interceptor.
+type InterceptorFunc func(station *Station, signal *SignalPack) ([]*SignalPack, error)
+
+// Intercept calls the func.
+func (this InterceptorFunc) Intercept(station *Station, signal *SignalPack) ([]*SignalPack, error) {
+	return this(station, signal)
+}
+
+var (
+	namedInterceptors       = make(map[string]Interceptor)
+	namedInterceptorsLocker sync.RWMutex
+)
+
+// RegisterInterceptor registers the interceptor by name, so the station can use it by name from the config.
+func RegisterInterceptor(name string, interceptor Interceptor) {
+	namedInterceptorsLocker.Lock()
+	defer namedInterceptorsLocker.Unlock()
+	namedInterceptors[name] = interceptor
+}
+
+// AddInterceptor appends the interceptor to the end of the chain of the station.
+func (this *Station) AddInterceptor(interceptor Interceptor) {
+	this.interceptorLocker.Lock()
+	defer this.interceptorLocker.Unlock()
+	this.interceptors = append(this.interceptors, interceptor)
+}
+
+// UseInterceptors appends the interceptors registered by the names to the chain in order,
+// none is appended if any name is not registered.
+func (this *Station) UseInterceptors(names []string) error {
+	namedInterceptorsLocker.RLock()
+	defer namedInterceptorsLocker.RUnlock()
+	interceptors := []Interceptor{}
+	for _, name := range names {
+		interceptor := namedInterceptors[name]
+		if interceptor == nil {
+			return errors.New("unknown interceptor: " + name)
+		}
+		interceptors = append(interceptors, interceptor)
+	}
+	for _, interceptor := range interceptors {
+		this.AddInterceptor(interceptor)
+	}
+	return nil
+}
+
+// intercept passes the signal through the chain of interceptors in order, each signal returned goes through the next interceptor.
+// A forked signal with the id of the original is given a new id, so it is not taken as broadcasted.
+func (this *Station) intercept(signal *SignalPack) ([]*SignalPack, error) {
+	this.interceptorLocker.RLock()
+	interceptors := this.interceptors
+	this.interceptorLocker.RUnlock()
+	id := signal.Signal.ID
+	signals := []*SignalPack{signal}
+	for _, interceptor := range interceptors {
+		next := []*SignalPack{}
+		for _, signal := range signals {
+			intercepted, err := interceptor.Intercept(this, signal)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, intercepted...)
+		}
+		signals = next
+	}
+	if len(signals) == 0 {
+		return signals, nil
+	}
+	original := signals[0]
+	for _, intercepted := range signals {
+		if intercepted == signal {
+			original = signal
+		}
+	}
+	for _, forked := range signals {
+		if forked != original && forked.Signal.ID == id {
+			forked.Signal.ID = uuid.New()
+		}
+	}
+	return signals, nil
+}
+
+// publish broadcasts the signal published by a client of the station to its channel,
+// or to the cluster if the channel is not opened in the station.
+func (this *Station) publish(signal *SignalPack) {
+	if channel := this.channel(signal.CID); channel != nil {
+		channel.Broadcast(signal)
+		return
+	}
+	this.Broadcast(signal)
+}
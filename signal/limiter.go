@@ -0,0 +1,148 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"saassoft.net/signaldistribution/base"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Violations is the count of each kind of limit violations.
+type Violations struct {
+	Frame   int64 // frames larger than the max frame size
+	Client  int64 // signals over the rate limit of client
+	Channel int64 // signals over the rate limit of channel
+	Station int64 // signals over the rate limit of station
+}
+
+// Limiter limits the rate of signals and bytes with token buckets.
+// A nil limiter allows everything.
+type Limiter struct {
+	signals tokenBucket
+	bytes   tokenBucket
+	last    time.Time
+	locker  sync.Mutex
+}
+
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+}
+
+// NewLimiter returns a limiter of the rate limit, or nil if the rate limit has no limit.
+func NewLimiter(limit base.RateLimit) *Limiter {
+	if limit.Signals <= 0 && limit.Bytes <= 0 {
+		return nil
+	}
+	return &Limiter{
+		signals: tokenBucket{rate: float64(limit.Signals), tokens: float64(limit.Signals)},
+		bytes:   tokenBucket{rate: float64(limit.Bytes), tokens: float64(limit.Bytes)},
+		last:    time.Now(),
+	}
+}
+
+// Allow takes one signal of the size from the buckets, it returns false and takes nothing if any bucket is short.
+func (this *Limiter) Allow(size int) bool {
+	return allowAll(size, this) < 0
+}
+
+// fits returns false if the size is over the bytes of the limit per second, such a signal never passes the limiter.
+func (this *Limiter) fits(size int) bool {
+	return this == nil || this.bytes.rate <= 0 || float64(size) <= this.bytes.rate
+}
+
+// has refills the buckets and returns true if they have one signal of the size, the locker must be held.
+func (this *Limiter) has(size int) bool {
+	now := time.Now()
+	elapsed := now.Sub(this.last).Seconds()
+	this.last = now
+	this.signals.refill(elapsed)
+	this.bytes.refill(elapsed)
+	return this.signals.has(1) && this.bytes.has(float64(size))
+}
+
+// allowAll takes one signal of the size from every limiter only if all of them have it,
+// it returns the index of the first limiter short of it, or -1 if the signal is allowed. nil limiters allow everything.
+// The limiters are locked in the order passed, so they must be passed in the same order everywhere.
+func allowAll(size int, limiters ...*Limiter) int {
+	for _, limiter := range limiters {
+		if limiter != nil {
+			limiter.locker.Lock()
+			defer limiter.locker.Unlock()
+		}
+	}
+	for i, limiter := range limiters {
+		if limiter != nil && !limiter.has(size) {
+			return i
+		}
+	}
+	for _, limiter := range limiters {
+		if limiter != nil {
+			limiter.signals.take(1)
+			limiter.bytes.take(float64(size))
+		}
+	}
+	return -1
+}
+
+// allowSignal checks the signal published by the client against the limits of the client, the channel and the station,
+// nothing is taken from any limit unless the signal is within all of them.
+// The violation is counted against the client and the limit, and replied to the client with an error.
+// A signal larger than the bytes of a limit per second is rejected as too large, as it would never pass.
+// It returns false if the signal is over a limit.
+func (this *Station) allowSignal(client *Client, channel *Channel, signal *Signal) bool {
+	size := len(signal.Text) + len(signal.Payload)
+	var channelLimiter *Limiter
+	if channel != nil {
+		channelLimiter = channel.limiter
+	}
+	limiters := []*Limiter{client.limiter, channelLimiter, this.limiter}
+	counters := []*int64{&this.violations.Client, &this.violations.Channel, &this.violations.Station}
+	texts := []string{base.ERROR_CLIENTLIMIT, base.ERROR_CHANNELLIMIT, base.ERROR_STATIONLIMIT}
+	short, text := -1, ""
+	for i, limiter := range limiters {
+		if !limiter.fits(size) {
+			short, text = i, base.ERROR_SIGNALTOOLARGE
+			break
+		}
+	}
+	if short < 0 {
+		if short = allowAll(size, limiters...); short < 0 {
+			return true
+		}
+		text = texts[short]
+	}
+	atomic.AddInt64(counters[short], 1)
+	atomic.AddInt64(&client.violations, 1)
+	client.pushError(signal.CID, text)
+	return false
+}
+
+// Violations returns the count of limit violations in the station.
+func (this *Station) Violations() Violations {
+	return Violations{
+		Frame:   atomic.LoadInt64(&this.violations.Frame),
+		Client:  atomic.LoadInt64(&this.violations.Client),
+		Channel: atomic.LoadInt64(&this.violations.Channel),
+		Station: atomic.LoadInt64(&this.violations.Station),
+	}
+}
+
+func (this *tokenBucket) refill(elapsed float64) {
+	this.tokens += this.rate * elapsed
+	if this.tokens > this.rate {
+		this.tokens = this.rate
+	}
+}
+
+func (this *tokenBucket) has(n float64) bool {
+	return this.rate <= 0 || this.tokens >= n
+}
+
+func (this *tokenBucket) take(n float64) {
+	if this.rate > 0 {
+		this.tokens -= n
+	}
+}
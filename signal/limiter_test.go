@@ -0,0 +1,46 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"saassoft.net/signaldistribution/base"
+	"testing"
+)
+
+// TestLimitersTakeNothingWhenOneIsShort checks a signal against two limiters, the second one is short,
+// so the first one still has its tokens.
+func TestLimitersTakeNothingWhenOneIsShort(t *testing.T) {
+	client := NewLimiter(base.RateLimit{Signals: 1})
+	channel := NewLimiter(base.RateLimit{Signals: 1})
+	channel.Allow(0)
+	if short := allowAll(0, client, nil, channel); short != 2 {
+		t.Fatal("short limiter:", short)
+	}
+	if !client.Allow(0) {
+		t.Fatal("tokens taken from the limiter that is not short")
+	}
+}
+
+// TestOversizeSignalIsRejected publishes a signal larger than the bytes per second of the channel limit,
+// it is rejected as too large, and counted against the client.
+func TestOversizeSignalIsRejected(t *testing.T) {
+	station := newTestStation(t, "s1", func(station *Station) {
+		station.ChannelLimit = base.RateLimit{Bytes: 10}
+	})
+	defer station.Close()
+
+	ws := station.join(t, "room", "p")
+	defer ws.Close()
+	publish(t, ws, &Signal{Type: base.SIGNALTYPE_SIGNAL, Text: "more than ten bytes"})
+	receiveUntil(t, ws, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_ERROR && signal.Text == base.ERROR_SIGNALTOOLARGE
+	})
+	for _, client := range station.Clients() {
+		if client.ViolationCount() != 1 {
+			t.Fatal("violations of the client:", client.ViolationCount())
+		}
+	}
+	if station.Violations().Channel != 1 {
+		t.Fatal("violations of the channel:", station.Violations().Channel)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"errors"
+	"log"
+	"saassoft.net/signaldistribution/base"
+	"strings"
+)
+
+// Moderate applies the admin action to the participants of the station, and reports it to the cluster by AdminHandler,
+// so the bans and the mutes are enforced by every station.
+func (this *Station) Moderate(moderation *base.Moderation) error {
+	if err := this.ApplyModeration(moderation); err != nil {
+		return err
+	}
+	if this.AdminHandler != nil {
+		this.AdminHandler(moderation)
+	}
+	return nil
+}
+
+// ApplyModeration applies the admin action to the participants of the station only.
+func (this *Station) ApplyModeration(moderation *base.Moderation) error {
+	switch moderation.Action {
+	case base.MODERATION_KICK, base.MODERATION_MUTE:
+		if moderation.ID == "" {
+			return errors.New("no id")
+		}
+	case base.MODERATION_BAN, base.MODERATION_UNBAN, base.MODERATION_UNMUTE:
+		if moderation.ID == "" && moderation.IP == "" {
+			return errors.New("no id or ip")
+		}
+	default:
+		return errors.New("unknown action: " + moderation.Action)
+	}
+	log.Println("station - admin:", moderation.Action, moderation.CID, moderation.ID, moderation.IP)
+	switch moderation.Action {
+	case base.MODERATION_KICK:
+		this.kick(moderation, base.ERROR_KICKED)
+		this.unsubscribeKicked(moderation)
+	case base.MODERATION_BAN:
+		this.keepModeration(moderation)
+		this.kick(moderation, base.ERROR_BANNED)
+	case base.MODERATION_MUTE:
+		this.keepModeration(moderation)
+	default:
+		this.moderationsLocker.Lock()
+		delete(this.moderations, moderation.Key())
+		this.moderationsLocker.Unlock()
+	}
+	return nil
+}
+
+// Moderations returns the bans and the mutes in effect.
+func (this *Station) Moderations() []*base.Moderation {
+	this.moderationsLocker.RLock()
+	defer this.moderationsLocker.RUnlock()
+	moderations := []*base.Moderation{}
+	for _, moderation := range this.moderations {
+		if !moderation.IsExpired() {
+			moderations = append(moderations, moderation)
+		}
+	}
+	return moderations
+}
+
+// keepModeration keeps the ban or the mute, and removes those expired.
+func (this *Station) keepModeration(moderation *base.Moderation) {
+	this.moderationsLocker.Lock()
+	defer this.moderationsLocker.Unlock()
+	for key, kept := range this.moderations {
+		if kept.IsExpired() {
+			delete(this.moderations, key)
+		}
+	}
+	this.moderations[moderation.Key()] = moderation
+}
+
+// kick removes the matched clients from the channels of the moderation, they receive an error with the text.
+func (this *Station) kick(moderation *base.Moderation, text string) {
+	for _, client := range this.Clients() {
+		for _, channel := range client.Channels() {
+			if moderation.Matches(channel.CID, client.Info.UPID, client.Info.PID, client.IP()) {
+				client.pushError(channel.CID, text)
+				this.leaveChannel(client, channel)
+			}
+		}
+	}
+}
+
+// unsubscribeKicked unsubscribes the matched clients from the patterns matching the channel of the moderation,
+// or else the kicked clients still receive the channel by them. A ban needs not it, as banned subscribers are skipped.
+func (this *Station) unsubscribeKicked(moderation *base.Moderation) {
+	for _, client := range this.Clients() {
+		if !moderation.Matches(moderation.CID, client.Info.UPID, client.Info.PID, client.IP()) {
+			continue
+		}
+		for _, pattern := range client.Patterns() {
+			if moderation.CID == "" || base.MatchChannel(pattern, moderation.CID) {
+				client.pushError(pattern, base.ERROR_KICKED)
+				this.unsubscribePattern(client, pattern)
+			}
+		}
+	}
+}
+
+// isModerated returns true if the participant in the channel is banned or muted, action is base.MODERATION_BAN or base.MODERATION_MUTE.
+func (this *Station) isModerated(action string, cid string, upid string, pid string, ip string) bool {
+	this.moderationsLocker.RLock()
+	defer this.moderationsLocker.RUnlock()
+	for _, moderation := range this.moderations {
+		if moderation.Action == action && !moderation.IsExpired() && moderation.Matches(cid, upid, pid, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *Station) isBanned(cid string, client *Client) bool {
+	return this.isModerated(base.MODERATION_BAN, cid, client.Info.UPID, client.Info.PID, client.IP())
+}
+
+func (this *Station) isMuted(cid string, client *Client) bool {
+	return this.isModerated(base.MODERATION_MUTE, cid, client.Info.UPID, client.Info.PID, client.IP())
+}
+
+// hostOf returns the host of the address formed as "host:port".
+func hostOf(addr string) string {
+	if idx := strings.LastIndex(addr, ":"); idx >= 0 {
+		return addr[:idx]
+	}
+	return addr
+}
@@ -3,7 +3,10 @@
 package signal
 
 import (
+	"errors"
 	"saassoft.net/signaldistribution/base"
+	"sync/atomic"
+	"time"
 )
 
 // Participant defines interfaces of participant in the station.
@@ -18,9 +21,157 @@ type Participant interface {
 }
 
 // ParticipantStruct describes the base informations of a participant.
+// Policy decides what to do when the Signals queue is full.
+// The queue is never closed, Close unblocks the pushers and the listener instead,
+// so it is safe to push signals to a participant that is quitting.
+// The signals expired in the queue are dropped by Pop.
 type ParticipantStruct struct {
-	UPID    string
-	PID     string
-	Signals chan *SignalPack
-	Remote  *base.RemoteInfo
+	dropped  int64
+	expired  int64
+	isClosed int32
+	UPID     string
+	PID      string
+	Signals  chan *SignalPack
+	Remote   *base.RemoteInfo
+	Policy   base.QueuePolicy
+	closed   chan bool
+}
+
+// NewParticipantStruct returns the base informations of a participant with an empty queue.
+func NewParticipantStruct(upid string, pid string, remote *base.RemoteInfo, policy base.QueuePolicy) ParticipantStruct {
+	size := policy.Size
+	if size <= 0 {
+		size = base.DEFAULT_QUEUE_SIZE
+	}
+	return ParticipantStruct{
+		UPID:    upid,
+		PID:     pid,
+		Remote:  remote,
+		Policy:  policy,
+		Signals: make(chan *SignalPack, size),
+		closed:  make(chan bool),
+	}
+}
+
+// DroppedCount returns the count of signals dropped because the queue was full.
+func (this *ParticipantStruct) DroppedCount() int64 {
+	return atomic.LoadInt64(&this.dropped)
+}
+
+// ExpiredCount returns the count of signals dropped because they expired in the queue.
+func (this *ParticipantStruct) ExpiredCount() int64 {
+	return atomic.LoadInt64(&this.expired)
+}
+
+// QueueDepth returns the count of signals waiting in the queue.
+func (this *ParticipantStruct) QueueDepth() int {
+	return len(this.Signals)
+}
+
+// Push pushes a signal to the queue, following the overflow policy when the queue is full.
+// With OVERFLOW_DISCONNECT the remote connection is closed on timeout,
+// so the participant is released by the goroutine reading from it.
+func (this *ParticipantStruct) Push(signal *SignalPack) error {
+	if this.IsClosed() {
+		return errors.New("participant is closed")
+	}
+	switch this.Policy.Overflow {
+	case base.OVERFLOW_DROPOLDEST:
+		for {
+			select {
+			case this.Signals <- signal:
+				return nil
+			default:
+			}
+			select {
+			case <-this.Signals:
+				atomic.AddInt64(&this.dropped, 1)
+			default:
+			}
+		}
+	case base.OVERFLOW_DROPNEWEST:
+		select {
+		case this.Signals <- signal:
+			return nil
+		default:
+			atomic.AddInt64(&this.dropped, 1)
+			return errors.New("queue is full")
+		}
+	case base.OVERFLOW_DISCONNECT:
+		select {
+		case this.Signals <- signal:
+			return nil
+		default:
+		}
+		timer := time.NewTimer(this.Policy.Timeout)
+		defer timer.Stop()
+		select {
+		case this.Signals <- signal:
+			return nil
+		case <-this.closed:
+			return errors.New("participant is closed")
+		case <-timer.C:
+			atomic.AddInt64(&this.dropped, 1)
+			_ = this.Remote.Conn.Close()
+			return errors.New("slow consumer")
+		}
+	}
+	select {
+	case this.Signals <- signal:
+		return nil
+	case <-this.closed:
+		return errors.New("participant is closed")
+	}
+}
+
+// PushWait pushes a signal to the queue, it waits until the queue has room or the participant is closed.
+func (this *ParticipantStruct) PushWait(signal *SignalPack) error {
+	select {
+	case this.Signals <- signal:
+		return nil
+	case <-this.closed:
+		return errors.New("participant is closed")
+	}
+}
+
+// Beat pushes a blank signal as heartbeat, it is skipped if the queue is full as signals are being sent anyway.
+func (this *ParticipantStruct) Beat() error {
+	if this.IsClosed() {
+		return errors.New("participant is closed")
+	}
+	select {
+	case this.Signals <- &SignalPack{Signal: Signal{Type: base.SIGNALTYPE_BLANK}, Time: time.Now(), Stations: []string{}}:
+	default:
+	}
+	return nil
+}
+
+// Pop waits for a signal from the queue, it returns false when the participant is closed.
+// Expired signals are skipped.
+func (this *ParticipantStruct) Pop() (*SignalPack, bool) {
+	for {
+		select {
+		case signal := <-this.Signals:
+			if signal != nil && signal.Signal.IsExpired() {
+				atomic.AddInt64(&this.expired, 1)
+				continue
+			}
+			return signal, signal != nil
+		case <-this.closed:
+			return nil, false
+		}
+	}
+}
+
+// IsClosed returns true if the participant is closed.
+func (this *ParticipantStruct) IsClosed() bool {
+	return atomic.LoadInt32(&this.isClosed) == 1
+}
+
+// Close closes the queue and the remote connection of the participant.
+func (this *ParticipantStruct) Close() {
+	if atomic.CompareAndSwapInt32(&this.isClosed, 0, 1) {
+		close(this.closed)
+	}
+	_ = this.Remote.Conn.Close()
 }
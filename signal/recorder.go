@@ -9,19 +9,21 @@ import (
 
 // Recorder represents a signals recorder client,it is kind of participant.
 // The recorder client listens to a station, when one of the station's channels receives a signal,
-// it sends the signal to the recorder server.
+// it sends the signal to the recorder server, in a binary frame if the recorder server supports it.
 type Recorder struct {
 	Info      ParticipantStruct
 	Station   *Station
 	RemoteSID string
 	Time      time.Time
+	codec     websocket.Codec
 }
 
-// StartBroadcast does not work in recorder client.
+// StartBroadcast does not work in recorder client, it only receives heartbeats from the recorder server.
 func (this *Recorder) StartBroadcast() {
 	for {
 		var signal SignalPack
-		if err := websocket.JSON.Receive(this.Info.Remote.Conn, &signal); err != nil {
+		this.Station.Heartbeat.SetReadDeadline(this.Info.Remote.Conn)
+		if err := this.codec.Receive(this.Info.Remote.Conn, &signal); err != nil {
 			return
 		}
 	}
@@ -29,12 +31,14 @@ func (this *Recorder) StartBroadcast() {
 
 // StartListen starts to listen the station, once a signal is received, sends the signal to the recorder server.
 func (this *Recorder) StartListen() {
-	for signal := range this.Info.Signals {
-		if signal == nil {
+	for {
+		signal, ok := this.Info.Pop()
+		if !ok {
 			return
 		}
 
-		if err := websocket.JSON.Send(this.Info.Remote.Conn, signal); err != nil {
+		if err := this.codec.Send(this.Info.Remote.Conn, signal); err != nil {
+			this.Info.Close()
 			break
 		}
 	}
@@ -47,8 +51,7 @@ func (this *Recorder) Relay(signal *SignalPack) error {
 
 // PushSignal pushes a signal to the recorder client.
 func (this *Recorder) PushSignal(signal *SignalPack) error {
-	this.Info.Signals <- signal
-	return nil
+	return this.Info.Push(signal)
 }
 
 //  PushSignal pushes signals to the recorder client.
@@ -60,6 +63,5 @@ func (this *Recorder) PushSignals(signals []*SignalPack) {
 
 // Close closes the recorder client,and release the resources of the recorder client.
 func (this *Recorder) Release() {
-	close(this.Info.Signals)
-	_ = this.Info.Remote.Conn.Close()
+	this.Info.Close()
 }
@@ -12,7 +12,7 @@ import (
 //
 // The relay client listens to local station and remote station,
 // when one of the local station's channels has produced a signal,
-// it relays the signal to the remote station;
+// it relays the signal to the remote station, in a binary frame if both stations support it;
 // when the relay client has received a signal from remote station,
 // it relays the signal to the channel that signal belongs to in the local station.
 type Relay struct {
@@ -23,6 +23,7 @@ type Relay struct {
 	RemoteIsTrunk bool
 	Time          time.Time
 	IsRequester   bool
+	codec         websocket.Codec
 }
 
 // StartBroadcast starts to wait for signals from remote station, once a signal is received,
@@ -30,21 +31,27 @@ type Relay struct {
 func (this *Relay) StartBroadcast() {
 	for {
 		var signal SignalPack
-		if err := websocket.JSON.Receive(this.Info.Remote.Conn, &signal); err != nil {
+		this.Station.Heartbeat.SetReadDeadline(this.Info.Remote.Conn)
+		if err := this.codec.Receive(this.Info.Remote.Conn, &signal); err != nil {
 			return
 		}
+		if signal.Signal.Type == base.SIGNALTYPE_BLANK {
+			continue
+		}
 		this.Relay(&signal)
 	}
 }
 
 // StartListen starts to listen the station, once a signal is received, sends the signal to remote stations.
 func (this *Relay) StartListen() {
-	for signal := range this.Info.Signals {
-		if signal == nil {
+	for {
+		signal, ok := this.Info.Pop()
+		if !ok {
 			return
 		}
 		if !base.StringInArray(this.RemoteSID, signal.Stations) {
-			if err := websocket.JSON.Send(this.Info.Remote.Conn, signal); err != nil {
+			if err := this.codec.Send(this.Info.Remote.Conn, signal); err != nil {
+				this.Info.Close()
 				break
 			}
 		}
@@ -62,8 +69,7 @@ func (this *Relay) Relay(signal *SignalPack) error {
 
 // PushSignal pushes a signal to the relay client.
 func (this *Relay) PushSignal(signal *SignalPack) error {
-	this.Info.Signals <- signal
-	return nil
+	return this.Info.Push(signal)
 }
 
 // PushSignal pushes signals to the relay client.
@@ -75,6 +81,5 @@ func (this *Relay) PushSignals(signals []*SignalPack) {
 
 // Close closes the relay client,and release the resources of the relay client.
 func (this *Relay) Release() {
-	close(this.Info.Signals)
-	_ = this.Info.Remote.Conn.Close()
+	this.Info.Close()
 }
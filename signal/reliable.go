@@ -0,0 +1,181 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"log"
+	"saassoft.net/signaldistribution/base"
+	"sync"
+	"time"
+)
+
+// Unacked keeps the signals pushed to a reliable client those are not acknowledged by the client yet.
+// A signal is kept from the time it is queued, so the signals dropped from the queue or left in it are not lost.
+// The signals are keyed by signal id, a redelivered signal keeps its id, so the client can drop duplicates.
+// At most max signals are kept, the client not acknowledging them is disconnected, see Client.keepUnacked.
+type Unacked struct {
+	signals map[string]*unackedSignal
+	max     int
+	locker  sync.Mutex
+}
+
+type unackedSignal struct {
+	signal   *SignalPack
+	sentTime time.Time
+}
+
+// Init sets up the unacked signals, max is the count of signals kept at most.
+func (this *Unacked) Init(max int) {
+	this.signals = make(map[string]*unackedSignal)
+	this.max = max
+}
+
+// Queued keeps the signal that is pushed to the queue of the client, it returns false if max signals are kept already.
+func (this *Unacked) Queued(signal *SignalPack) bool {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	if this.signals[signal.Signal.ID] == nil && len(this.signals) >= this.max {
+		return false
+	}
+	this.signals[signal.Signal.ID] = &unackedSignal{signal: signal, sentTime: time.Now()}
+	return true
+}
+
+// Sent renews the time of the signal that has been sent to the client, unless the signal has been acknowledged.
+func (this *Unacked) Sent(signal *SignalPack) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	if unacked := this.signals[signal.Signal.ID]; unacked != nil {
+		unacked.sentTime = time.Now()
+	}
+}
+
+// Ack removes the signal acknowledged by the client, it returns false if the signal is not kept.
+func (this *Unacked) Ack(id string) bool {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	if this.signals[id] == nil {
+		return false
+	}
+	delete(this.signals, id)
+	return true
+}
+
+// Expired returns the signals queued or sent before the timeout, they are kept until acknowledged.
+// The signals those lived out their time to live are removed instead, they are never redelivered.
+func (this *Unacked) Expired(timeout time.Duration) []*SignalPack {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	now := time.Now()
+	signals := []*SignalPack{}
+	for id, unacked := range this.signals {
+		if unacked.signal.Signal.IsExpired() {
+			delete(this.signals, id)
+		} else if now.Sub(unacked.sentTime) >= timeout {
+			unacked.sentTime = now
+			signals = append(signals, unacked.signal)
+		}
+	}
+	return signals
+}
+
+// All returns all the signals those are not acknowledged, the expired signals are removed.
+func (this *Unacked) All() []*SignalPack {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	signals := []*SignalPack{}
+	for id, unacked := range this.signals {
+		if unacked.signal.Signal.IsExpired() {
+			delete(this.signals, id)
+		} else {
+			signals = append(signals, unacked.signal)
+		}
+	}
+	return signals
+}
+
+// keptUnacked is the unacked signals of a quitted reliable client, they are redelivered when the client reconnects.
+type keptUnacked struct {
+	signals []*SignalPack
+	time    time.Time
+}
+
+// keepUnacked keeps the unacked signals of the client that is quitting, including those still in its queue.
+// At most MaxUnacked signals are kept for the participant, the oldest are dropped.
+func (this *Station) keepUnacked(client *Client) {
+	signals := client.unacked.All()
+	if len(signals) == 0 {
+		return
+	}
+	this.unackedLocker.Lock()
+	defer this.unackedLocker.Unlock()
+	kept := this.unacked[client.Info.PID]
+	if kept == nil {
+		kept = &keptUnacked{}
+		this.unacked[client.Info.PID] = kept
+	}
+	kept.signals = append(kept.signals, signals...)
+	if over := len(kept.signals) - this.MaxUnacked; over > 0 {
+		log.Println("station - client: unacked signals dropped:", client.Info.PID, over)
+		kept.signals = kept.signals[over:]
+	}
+	kept.time = time.Now()
+}
+
+// takeUnacked returns the kept unacked signals of the participant in the channel, and forgets them.
+// The signals expired while kept are dropped.
+func (this *Station) takeUnacked(pid string, cid string) []*SignalPack {
+	this.unackedLocker.Lock()
+	defer this.unackedLocker.Unlock()
+	kept := this.unacked[pid]
+	if kept == nil {
+		return nil
+	}
+	taken := []*SignalPack{}
+	rest := []*SignalPack{}
+	for _, signal := range kept.signals {
+		if signal.Signal.IsExpired() {
+			continue
+		}
+		if signal.CID == cid {
+			taken = append(taken, signal)
+		} else {
+			rest = append(rest, signal)
+		}
+	}
+	kept.signals = rest
+	if len(rest) == 0 {
+		delete(this.unacked, pid)
+	}
+	return taken
+}
+
+// isPublished returns true if the signal with the id has been published by a reliable client, otherwise marks it as published.
+func (this *Station) isPublished(id string) bool {
+	this.unackedLocker.Lock()
+	defer this.unackedLocker.Unlock()
+	if !this.published[id].IsZero() {
+		return true
+	}
+	this.published[id] = time.Now()
+	return false
+}
+
+func (this *Station) reduceUnacked() {
+	time.AfterFunc(base.STATION_UNACKED_TIMEOUT, func() {
+		now := time.Now()
+		this.unackedLocker.Lock()
+		for pid, kept := range this.unacked {
+			if now.Sub(kept.time) >= base.STATION_UNACKED_TIMEOUT {
+				delete(this.unacked, pid)
+			}
+		}
+		for id, time := range this.published {
+			if now.Sub(time) >= base.STATION_UNACKED_TIMEOUT {
+				delete(this.published, id)
+			}
+		}
+		this.unackedLocker.Unlock()
+		this.reduceUnacked()
+	})
+}
@@ -0,0 +1,58 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"saassoft.net/signaldistribution/base"
+	"testing"
+	"time"
+)
+
+// TestExpiredSignalsAreNotRedelivered keeps an expired and a live signal unacked,
+// only the live one is redelivered, or kept for the client reconnecting.
+func TestExpiredSignalsAreNotRedelivered(t *testing.T) {
+	expired := &SignalPack{Signal: Signal{ID: "expired", ExpireTime: time.Now().Add(-time.Second)}, CID: "room"}
+	live := &SignalPack{Signal: Signal{ID: "live", ExpireTime: time.Now().Add(time.Hour)}, CID: "room"}
+	client := &Client{Info: ParticipantStruct{PID: "p"}}
+	client.unacked.Init(base.DEFAULT_MAX_UNACKED)
+	client.unacked.Queued(expired)
+	client.unacked.Queued(live)
+
+	if signals := client.unacked.Expired(0); len(signals) != 1 || signals[0] != live {
+		t.Fatal("redelivered:", signals)
+	}
+	if client.unacked.Ack("expired") {
+		t.Fatal("expired signal is still kept")
+	}
+
+	client.unacked.Queued(expired)
+	station := &Station{MaxUnacked: base.DEFAULT_MAX_UNACKED, unacked: make(map[string]*keptUnacked)}
+	station.keepUnacked(client)
+	if signals := station.unacked["p"].signals; len(signals) != 1 || signals[0] != live {
+		t.Fatal("kept:", signals)
+	}
+	station.unacked["p"].signals = append(station.unacked["p"].signals, expired)
+	if signals := station.takeUnacked("p", "room"); len(signals) != 1 || signals[0] != live {
+		t.Fatal("taken:", signals)
+	}
+}
+
+// TestUnackedIsBounded keeps at most max signals, a redelivered signal is kept again.
+func TestUnackedIsBounded(t *testing.T) {
+	unacked := Unacked{}
+	unacked.Init(2)
+	first := &SignalPack{Signal: Signal{ID: "1"}}
+	if !unacked.Queued(first) || !unacked.Queued(&SignalPack{Signal: Signal{ID: "2"}}) {
+		t.Fatal("signals under max are not kept")
+	}
+	if unacked.Queued(&SignalPack{Signal: Signal{ID: "3"}}) {
+		t.Fatal("signal over max is kept")
+	}
+	if !unacked.Queued(first) {
+		t.Fatal("redelivered signal is not kept")
+	}
+	unacked.Ack("1")
+	if !unacked.Queued(&SignalPack{Signal: Signal{ID: "3"}}) {
+		t.Fatal("signal is not kept after ack")
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"sync"
+	"time"
+)
+
+// Requests keeps the requests sent by a client those are waiting for replies, keyed by correlation id.
+type Requests struct {
+	timers map[string]*time.Timer
+	locker sync.Mutex
+}
+
+// Init sets up the requests.
+func (this *Requests) Init() {
+	this.timers = make(map[string]*time.Timer)
+}
+
+// Start keeps the request with the correlation id, timeoutHandler is called if the request is not ended in timeout.
+func (this *Requests) Start(correlationID string, timeout time.Duration, timeoutHandler func()) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	if timer := this.timers[correlationID]; timer != nil {
+		timer.Stop()
+	}
+	this.timers[correlationID] = time.AfterFunc(timeout, func() {
+		if this.End(correlationID) {
+			timeoutHandler()
+		}
+	})
+}
+
+// End removes the request with the correlation id, it returns false if the request is not waiting.
+func (this *Requests) End(correlationID string) bool {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	timer := this.timers[correlationID]
+	if timer == nil {
+		return false
+	}
+	timer.Stop()
+	delete(this.timers, correlationID)
+	return true
+}
+
+// Close stops waiting for all the requests.
+func (this *Requests) Close() {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	for correlationID, timer := range this.timers {
+		timer.Stop()
+		delete(this.timers, correlationID)
+	}
+}
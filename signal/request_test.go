@@ -0,0 +1,74 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"saassoft.net/signaldistribution/base"
+	"testing"
+	"time"
+)
+
+// TestReplyIsRoutedToRemoteRequester sends a request from one station, a client of the other station replies twice,
+// the requester receives the first reply with the correlation id, and neither the second reply nor a timeout.
+func TestReplyIsRoutedToRemoteRequester(t *testing.T) {
+	a := newTestStation(t, "a", func(station *Station) {
+		station.RequestTimeout = 500 * time.Millisecond
+	})
+	defer a.Close()
+	b := newTestStation(t, "b", nil)
+	defer b.Close()
+	go b.RelayWithStation(a.addr)
+	waitFor(t, "relay to join", func() bool {
+		return a.RelayCount() == 1 && b.RelayCount() == 1
+	})
+
+	requester := a.join(t, "rpc", "requester")
+	defer requester.Close()
+	responder := b.join(t, "rpc", "responder")
+	defer responder.Close()
+	publish(t, requester, &Signal{Type: base.SIGNALTYPE_REQUEST, CorrelationID: "c1", Text: "question"})
+	request := receiveUntil(t, responder, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_REQUEST
+	})
+	if request.CorrelationID != "c1" || request.ReplyTo == "" {
+		t.Fatal("request received:", request.CorrelationID, request.ReplyTo)
+	}
+	for _, text := range []string{"answer", "late answer"} {
+		publish(t, responder, &Signal{Type: base.SIGNALTYPE_REPLY, ReplyTo: request.ReplyTo, CorrelationID: "c1", Text: text})
+	}
+
+	reply := receiveUntil(t, requester, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_REPLY || signal.Type == base.SIGNALTYPE_ERROR
+	})
+	if reply.Type != base.SIGNALTYPE_REPLY || reply.CorrelationID != "c1" || reply.Text != "answer" {
+		t.Fatal("requester received:", reply.Type, reply.CorrelationID, reply.Text)
+	}
+	requester.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var signal Signal
+		if err := JSONCodec.Receive(requester, &signal); err != nil {
+			break
+		}
+		if signal.Type == base.SIGNALTYPE_REPLY || signal.Type == base.SIGNALTYPE_ERROR {
+			t.Fatal("requester received after the reply:", signal.Type, signal.Text)
+		}
+	}
+}
+
+// TestRequestTimesOut sends a request that nobody replies, the requester receives the timeout error with the correlation id.
+func TestRequestTimesOut(t *testing.T) {
+	station := newTestStation(t, "s1", func(station *Station) {
+		station.RequestTimeout = 100 * time.Millisecond
+	})
+	defer station.Close()
+
+	requester := station.join(t, "rpc", "requester")
+	defer requester.Close()
+	publish(t, requester, &Signal{Type: base.SIGNALTYPE_REQUEST, CorrelationID: "c1", Text: "question"})
+	signal := receiveUntil(t, requester, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_ERROR
+	})
+	if signal.Text != base.ERROR_TIMEOUT || signal.CorrelationID != "c1" {
+		t.Fatal("requester received:", signal.Text, signal.CorrelationID)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"saassoft.net/signaldistribution/base"
+	"time"
+)
+
+// retain keeps the retained signal as the current value of its channel, unless a newer one is kept.
+// A retained signal without text and payload clears the current value.
+// The values are kept by the station, so they survive the close of idle channels, until their time to live expires.
+func (this *Station) retain(signal *SignalPack) {
+	if !signal.Signal.Retain || signal.Signal.To != "" || !isRetainable(&signal.Signal) {
+		return
+	}
+	this.retainedLocker.Lock()
+	defer this.retainedLocker.Unlock()
+	if current := this.retained[signal.CID]; current != nil && current.Time.After(signal.Time) {
+		return
+	}
+	if signal.Signal.Text == "" && len(signal.Signal.Payload) == 0 {
+		delete(this.retained, signal.CID)
+		return
+	}
+	this.retained[signal.CID] = signal
+}
+
+// isStaleRetained returns true if the signal is retained and the current value of its channel is the same or newer.
+// The current values are pushed to each relay that joins, the stale ones are dropped by the remote station.
+func (this *Station) isStaleRetained(signal *SignalPack) bool {
+	if !signal.Signal.Retain || signal.Signal.To != "" {
+		return false
+	}
+	current := this.Retained(signal.CID)
+	return current != nil && (current.Signal.ID == signal.Signal.ID || current.Time.After(signal.Time))
+}
+
+// Retained returns the current value of the channel, or nil if there is none.
+func (this *Station) Retained(cid string) *SignalPack {
+	this.retainedLocker.RLock()
+	defer this.retainedLocker.RUnlock()
+	return this.retained[cid]
+}
+
+// RetainedSignals returns the current values of all the channels.
+func (this *Station) RetainedSignals() []*SignalPack {
+	this.retainedLocker.RLock()
+	defer this.retainedLocker.RUnlock()
+	signals := []*SignalPack{}
+	for _, signal := range this.retained {
+		signals = append(signals, signal)
+	}
+	return signals
+}
+
+// sendRetained sends the current value of the channel to the client through the channel as a unicast signal,
+// so it follows the signals broadcasted before, e.g. the join of the client.
+func (this *Station) sendRetained(client *Client, channel *Channel) {
+	retained := this.Retained(channel.CID)
+	if retained == nil || retained.Signal.IsExpired() {
+		return
+	}
+	signal := *retained
+	signal.Signal.To = client.Info.UPID
+	signal.Signal.Seq = 0
+	signal.Signal.SeqSID = ""
+	signal.Stations = []string{}
+	channel.Broadcast(&signal)
+}
+
+// isRetainable returns false if the signal is larger than MAX_RETAINED_SIZE, clients can not retain it.
+func isRetainable(signal *Signal) bool {
+	return len(signal.Text)+len(signal.Payload) <= base.MAX_RETAINED_SIZE
+}
+
+// reduceRetained removes the retained signals those expired, so the values of idle channels do not pile up.
+func (this *Station) reduceRetained() {
+	time.AfterFunc(base.STATION_RETAINED_INTERVAL, func() {
+		this.removeExpiredRetained()
+		this.reduceRetained()
+	})
+}
+
+func (this *Station) removeExpiredRetained() {
+	this.retainedLocker.Lock()
+	defer this.retainedLocker.Unlock()
+	for cid, signal := range this.retained {
+		if signal.Signal.IsExpired() {
+			delete(this.retained, cid)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"saassoft.net/signaldistribution/base"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRetainedValueIsReplicated retains a signal on one station, it is sent to the clients joining in the channel
+// on the other station, and on the same station after the idle channel is closed.
+func TestRetainedValueIsReplicated(t *testing.T) {
+	a := newTestStation(t, "a", nil)
+	defer a.Close()
+	b := newTestStation(t, "b", nil)
+	defer b.Close()
+	go b.RelayWithStation(a.addr)
+	waitFor(t, "relay to join", func() bool {
+		return a.RelayCount() == 1 && b.RelayCount() == 1
+	})
+
+	publisher := a.join(t, "status", "publisher")
+	publish(t, publisher, &Signal{Type: base.SIGNALTYPE_SIGNAL, Text: "up", Retain: true})
+	waitFor(t, "value to be replicated", func() bool {
+		return b.Retained("status") != nil
+	})
+	publisher.Close()
+	waitFor(t, "channel to close", func() bool {
+		return a.ChannelCount() == 0
+	})
+
+	for _, station := range []*testStation{a, b} {
+		ws := station.join(t, "status", "reader")
+		signal := receiveUntil(t, ws, func(signal *Signal) bool {
+			return signal.Type == base.SIGNALTYPE_SIGNAL
+		})
+		ws.Close()
+		if signal.Text != "up" {
+			t.Fatal("retained value on", station.Info.SID, ":", signal.Text)
+		}
+	}
+}
+
+// TestRetainedValueIsBounded retains a signal too large and one that expires, neither is kept.
+func TestRetainedValueIsBounded(t *testing.T) {
+	station := newTestStation(t, "s1", nil)
+	defer station.Close()
+
+	ws := station.join(t, "status", "publisher")
+	defer ws.Close()
+	publish(t, ws, &Signal{Type: base.SIGNALTYPE_SIGNAL, Text: strings.Repeat("x", base.MAX_RETAINED_SIZE+1), Retain: true})
+	receiveUntil(t, ws, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_ERROR && signal.Text == "retained signal too large"
+	})
+	publish(t, ws, &Signal{Type: base.SIGNALTYPE_SIGNAL, Text: "up", Retain: true, TTL: 10})
+	waitFor(t, "value to be retained", func() bool {
+		return station.Retained("status") != nil
+	})
+	time.Sleep(20 * time.Millisecond)
+	station.removeExpiredRetained()
+	if station.Retained("status") != nil {
+		t.Fatal("expired value is kept")
+	}
+}
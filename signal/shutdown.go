@@ -0,0 +1,87 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"log"
+	"saassoft.net/signaldistribution/base"
+	"sync/atomic"
+	"time"
+)
+
+// Drain stops accepting joins of clients and relays and publishes of clients,
+// asks every client to reconnect to another station by a redirect signal after the signals of its channels,
+// then waits for the queues of the clients, relays and recorders to be flushed in timeout.
+func (this *Station) Drain(timeout time.Duration) {
+	if !atomic.CompareAndSwapInt32(&this.draining, 0, 1) {
+		return
+	}
+	log.Println("station: draining.")
+	redirected := make(chan bool)
+	go this.redirectClients(redirected)
+	deadline := time.Now().Add(timeout)
+	for {
+		time.Sleep(base.STATION_DRAIN_INTERVAL)
+		select {
+		case <-redirected:
+			if this.isFlushed() {
+				return
+			}
+		default:
+		}
+		if time.Now().After(deadline) {
+			log.Println("station: drain timeout, some signals are not flushed.")
+			return
+		}
+	}
+}
+
+// IsDraining returns true if the station is shutting down.
+func (this *Station) IsDraining() bool {
+	return atomic.LoadInt32(&this.draining) == 1
+}
+
+// Close disconnects all the clients, relays and recorders, they are released as disconnected by remote.
+func (this *Station) Close() {
+	atomic.StoreInt32(&this.draining, 1)
+	for _, client := range this.Clients() {
+		client.Info.Close()
+	}
+	for _, relay := range this.Relays() {
+		relay.Info.Close()
+	}
+	for _, recorder := range this.Recorders() {
+		recorder.Info.Close()
+	}
+}
+
+// redirectClients pushes the redirect to the clients by their channels, so it follows the signals already sent to them,
+// then to the clients those are in no channel.
+func (this *Station) redirectClients(done chan bool) {
+	for _, channel := range this.Channels() {
+		channel.Redirect()
+	}
+	for _, client := range this.Clients() {
+		client.redirect()
+	}
+	close(done)
+}
+
+func (this *Station) isFlushed() bool {
+	for _, client := range this.Clients() {
+		if len(client.Info.Signals) > 0 {
+			return false
+		}
+	}
+	for _, relay := range this.Relays() {
+		if len(relay.Info.Signals) > 0 {
+			return false
+		}
+	}
+	for _, recorder := range this.Recorders() {
+		if len(recorder.Info.Signals) > 0 {
+			return false
+		}
+	}
+	return true
+}
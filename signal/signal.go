@@ -12,14 +12,42 @@ import (
 )
 
 // Signal represents a signal object.
+// If To is not empty, the signal is a unicast signal, it is only sent to the participant whose PID or UPID is To.
 type Signal struct {
-	ID   string
-	PID  string
-	Type base.SignalType
-	Text string
+	ID  string
+	PID string
+	CID string // channel of the signal, it can be empty when a client sends a signal to the channel it joined in
+	To  string
+	// sequence number of the signal in the channel of the station that delivers it, it increases by one per signal,
+	// so clients can detect gaps. Unicast signals and signals to channels not opened in the station have no Seq.
+	Seq uint64
+	// sid of the station and epoch of the channel history numbering Seq, a client resumes by the sequence of the same history only
+	SeqSID string
+	Type   base.SignalType
+	Text   string
+	// a request carries the upid of the requester and a correlation id, the reply is sent to ReplyTo with the same CorrelationID
+	ReplyTo       string
+	CorrelationID string
+	// binary content and its media type, e.g. "application/x-protobuf",
+	// the payload is carried as raw bytes in binary frames, and in base64 in JSON text frames
+	ContentType string
+	Payload     []byte
+	// metadata delivered unchanged, e.g. trace id, the headers prefixed with base.HEADER_SYSTEM_PREFIX are set by the station
+	Headers map[string]string
+	// time to live in milliseconds, zero means never expires. The station receiving the signal from the client sets ExpireTime,
+	// an expired signal is dropped instead of being delivered, relayed, replayed or recorded.
+	TTL        int64
+	ExpireTime time.Time
+	Retain     bool // the signal becomes the current value of its channel in every station, sent to each joining client
+}
+
+// IsExpired returns true if the signal has a time to live and it is expired.
+func (this *Signal) IsExpired() bool {
+	return !this.ExpireTime.IsZero() && time.Now().After(this.ExpireTime)
 }
 
 // SignalPack is the package of singal for being transmitted between station.
+// The payload and the content type travel in the packed signal.
 type SignalPack struct {
 	Signal   Signal
 	CID      string
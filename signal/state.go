@@ -0,0 +1,221 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"encoding/json"
+	"errors"
+	"saassoft.net/signaldistribution/base"
+	"sync"
+	"time"
+)
+
+// StateEntry is a key of the state of a channel, versioned by the time and the sid of the station that set it.
+// A deleted key is kept as a tombstone for STATION_TOMBSTONE_TIMEOUT, so an older setting arriving late does not bring it back.
+type StateEntry struct {
+	Key     string
+	Value   string
+	Deleted bool
+	Time    int64 // unix time in nanoseconds
+	SID     string
+}
+
+// newerThan returns true if the entry is a later version than the other, the sid breaks the tie of time.
+func (this *StateEntry) newerThan(other *StateEntry) bool {
+	if this.Time != other.Time {
+		return this.Time > other.Time
+	}
+	return this.SID > other.SID
+}
+
+// State is the key-value state of a channel. Every station hosting the channel keeps a replica,
+// the changes are broadcasted as state signals whose text is the json of the changed entries,
+// and each key converges on the last writer.
+type State struct {
+	entries map[string]*StateEntry
+	locker  sync.RWMutex
+}
+
+// NewState returns an empty state.
+func NewState() *State {
+	return &State{entries: make(map[string]*StateEntry)}
+}
+
+// Merge merges the entries into the state, it returns the entries those are newer than the state.
+func (this *State) Merge(entries []*StateEntry) []*StateEntry {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	merged := []*StateEntry{}
+	for _, entry := range entries {
+		if current := this.entries[entry.Key]; current == nil || entry.newerThan(current) {
+			this.entries[entry.Key] = entry
+			merged = append(merged, entry)
+		}
+	}
+	return merged
+}
+
+// canSet returns false if the key is not set and the state has MAX_STATE_KEYS keys already.
+func (this *State) canSet(key string) bool {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+	if entry := this.entries[key]; entry != nil && !entry.Deleted {
+		return true
+	}
+	count := 0
+	for _, entry := range this.entries {
+		if !entry.Deleted {
+			count++
+		}
+	}
+	return count < base.MAX_STATE_KEYS
+}
+
+// removeTombstones removes the keys deleted before the time in unix nanoseconds, it returns the count of keys left.
+func (this *State) removeTombstones(before int64) int {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	for key, entry := range this.entries {
+		if entry.Deleted && entry.Time < before {
+			delete(this.entries, key)
+		}
+	}
+	return len(this.entries)
+}
+
+// Snapshot returns the entries of the state, the deleted ones are included if withDeleted.
+func (this *State) Snapshot(withDeleted bool) []*StateEntry {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+	entries := []*StateEntry{}
+	for _, entry := range this.entries {
+		if withDeleted || !entry.Deleted {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// State returns the state of the channel, or nil if the channel has no state.
+func (this *Station) State(cid string) *State {
+	this.statesLocker.RLock()
+	defer this.statesLocker.RUnlock()
+	return this.states[cid]
+}
+
+// setState sets or deletes the key in the state of the channel that the client joined in, and broadcasts the change.
+func (this *Station) setState(client *Client, cid string, key string, value string, deleted bool) error {
+	if key == "" {
+		return errors.New("no key")
+	}
+	channel := client.Channel(cid)
+	if channel == nil {
+		return errors.New("not in channel")
+	}
+	if !client.Identity.Can(cid, base.PERMISSION_PUBLISH) {
+		return errors.New("no permission to publish")
+	}
+	if this.isMuted(cid, client) {
+		return errors.New(base.ERROR_MUTED)
+	}
+	if len(key)+len(value) > base.MAX_STATE_ENTRY_SIZE {
+		return errors.New("state entry too large")
+	}
+	if state := this.State(cid); !deleted && state != nil && !state.canSet(key) {
+		return errors.New("too many state keys")
+	}
+	entry := &StateEntry{Key: key, Value: value, Deleted: deleted, Time: time.Now().UnixNano(), SID: this.Info.SID}
+	signal, err := this.newStateSignal(cid, []*StateEntry{entry})
+	if err != nil {
+		return err
+	}
+	signal.Signal.PID = client.Info.PID
+	return channel.Broadcast(signal)
+}
+
+// mergeState merges the entries of the state signal into the state of its channel,
+// it returns false if the signal changes nothing. The signals passing a channel are merged by the channel,
+// the others when they are broadcasted to the station.
+// statesLocker is held while merging, so the state is not removed by reduceStates meanwhile.
+func (this *Station) mergeState(signal *SignalPack) bool {
+	if signal.Signal.Type != base.SIGNALTYPE_STATE || signal.Signal.To != "" {
+		return true
+	}
+	var entries []*StateEntry
+	if err := json.Unmarshal([]byte(signal.Signal.Text), &entries); err != nil {
+		return false
+	}
+	this.statesLocker.Lock()
+	defer this.statesLocker.Unlock()
+	state := this.states[signal.CID]
+	if state == nil {
+		state = NewState()
+		this.states[signal.CID] = state
+	}
+	return len(state.Merge(entries)) > 0
+}
+
+// reduceStates removes the tombstones older than STATION_TOMBSTONE_TIMEOUT, and the states left empty.
+func (this *Station) reduceStates() {
+	time.AfterFunc(base.STATION_TOMBSTONE_TIMEOUT, func() {
+		this.removeTombstones(time.Now().Add(-base.STATION_TOMBSTONE_TIMEOUT).UnixNano())
+		this.reduceStates()
+	})
+}
+
+func (this *Station) removeTombstones(before int64) {
+	this.statesLocker.Lock()
+	defer this.statesLocker.Unlock()
+	for cid, state := range this.states {
+		if state.removeTombstones(before) == 0 {
+			delete(this.states, cid)
+		}
+	}
+}
+
+// sendState sends the snapshot of the state of the channel to the client through the channel as a unicast signal.
+func (this *Station) sendState(client *Client, channel *Channel) {
+	state := this.State(channel.CID)
+	if state == nil {
+		return
+	}
+	entries := state.Snapshot(false)
+	if len(entries) == 0 {
+		return
+	}
+	if signal, err := this.newStateSignal(channel.CID, entries); err == nil {
+		signal.Signal.To = client.Info.UPID
+		channel.Broadcast(signal)
+	}
+}
+
+// stateSignals returns the snapshots of the states of all channels with tombstones, for syncing a relay that joins.
+func (this *Station) stateSignals() []*SignalPack {
+	this.statesLocker.RLock()
+	states := make(map[string]*State, len(this.states))
+	for cid, state := range this.states {
+		states[cid] = state
+	}
+	this.statesLocker.RUnlock()
+	signals := []*SignalPack{}
+	for cid, state := range states {
+		if signal, err := this.newStateSignal(cid, state.Snapshot(true)); err == nil {
+			signals = append(signals, signal)
+		}
+	}
+	return signals
+}
+
+func (this *Station) newStateSignal(cid string, entries []*StateEntry) (*SignalPack, error) {
+	text, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+	return &SignalPack{
+		Signal:   Signal{ID: uuid.New(), CID: cid, Type: base.SIGNALTYPE_STATE, Text: string(text)},
+		CID:      cid,
+		Time:     time.Now(),
+		Stations: []string{},
+	}, nil
+}
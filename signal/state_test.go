@@ -0,0 +1,109 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"saassoft.net/signaldistribution/base"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestStateConvergesAcrossStations sets and deletes the same keys from clients of two relayed stations at once,
+// both stations end with the same state.
+func TestStateConvergesAcrossStations(t *testing.T) {
+	a := newTestStation(t, "a", nil)
+	defer a.Close()
+	b := newTestStation(t, "b", nil)
+	defer b.Close()
+	go b.RelayWithStation(a.addr)
+	waitFor(t, "relay to join", func() bool {
+		return a.RelayCount() == 1 && b.RelayCount() == 1
+	})
+
+	writers := sync.WaitGroup{}
+	for _, station := range []*testStation{a, b} {
+		ws := station.join(t, "room", "writer-"+station.Info.SID)
+		defer ws.Close()
+		writers.Add(1)
+		go func(sid string) {
+			defer writers.Done()
+			for n := 0; n < 100; n++ {
+				cmd := base.CLIENTCMD_SET + ":room:k" + strconv.Itoa(n%5) + "=" + sid + strconv.Itoa(n)
+				if n%7 == 0 {
+					cmd = base.CLIENTCMD_DELETE + ":room:k" + strconv.Itoa(n%5)
+				}
+				if err := JSONCodec.Send(ws, &Signal{Type: base.SIGNALTYPE_CMD, Text: cmd}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			if err := JSONCodec.Send(ws, &Signal{Type: base.SIGNALTYPE_CMD, Text: base.CLIENTCMD_SET + ":room:done-" + sid + "=1"}); err != nil {
+				t.Error(err)
+			}
+		}(station.Info.SID)
+	}
+	writers.Wait()
+
+	snapshot := func(station *testStation) map[string]StateEntry {
+		entries := map[string]StateEntry{}
+		if state := station.State("room"); state != nil {
+			for _, entry := range state.Snapshot(true) {
+				entries[entry.Key] = *entry
+			}
+		}
+		return entries
+	}
+	waitFor(t, "states to converge", func() bool {
+		sa, sb := snapshot(a), snapshot(b)
+		if sa["done-a"].Value == "" || sa["done-b"].Value == "" || len(sa) != len(sb) {
+			return false
+		}
+		for key, entry := range sa {
+			if sb[key] != entry {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// TestStateIsBounded sets more keys than MAX_STATE_KEYS and a value too large, they are rejected,
+// and the tombstones are removed after the timeout with the state left empty.
+func TestStateIsBounded(t *testing.T) {
+	state := NewState()
+	entries := []*StateEntry{}
+	for n := 0; n < base.MAX_STATE_KEYS; n++ {
+		entries = append(entries, &StateEntry{Key: strconv.Itoa(n), Value: "v", Time: 1})
+	}
+	state.Merge(entries)
+	if state.canSet("new") {
+		t.Fatal("key over the max can be set")
+	}
+	if !state.canSet("0") {
+		t.Fatal("key set can not be set again")
+	}
+
+	station := newTestStation(t, "s1", nil)
+	defer station.Close()
+	ws := station.join(t, "room", "p")
+	defer ws.Close()
+	publish(t, ws, &Signal{Type: base.SIGNALTYPE_CMD, Text: base.CLIENTCMD_SET + ":room:k=" + strings.Repeat("x", base.MAX_STATE_ENTRY_SIZE)})
+	receiveUntil(t, ws, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_ERROR && signal.Text == "state entry too large"
+	})
+	publish(t, ws, &Signal{Type: base.SIGNALTYPE_CMD, Text: base.CLIENTCMD_DELETE + ":room:k"})
+	waitFor(t, "tombstone", func() bool {
+		return station.State("room") != nil && len(station.State("room").Snapshot(true)) == 1
+	})
+	station.removeTombstones(time.Now().Add(-time.Hour).UnixNano())
+	if station.State("room") == nil {
+		t.Fatal("tombstone removed before the timeout")
+	}
+	station.removeTombstones(time.Now().UnixNano())
+	if station.State("room") != nil {
+		t.Fatal("state left with the tombstone:", station.State("room").Snapshot(true))
+	}
+}
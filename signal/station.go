@@ -5,57 +5,178 @@ package signal
 import (
 	"code.google.com/p/go-uuid/uuid"
 	"code.google.com/p/go.net/websocket"
+	"encoding/json"
 	"errors"
 	"log"
+	"net/url"
 	"saassoft.net/signaldistribution/base"
 	"strconv"
 	//"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Station represents a station server that can relay signals to other stations, and can broadcast signals to the end-clients.
+// The zero values of the options mean the defaults, or no limit.
+//
+// Each map of the station is guarded by its own locker, so the station can be accessed from any goroutine.
+// channelsLocker is held while a client joins in a channel, so a channel is never closed with a joining client.
+// relayLocker serializes relay joins, it is held during the handshake with the remote station.
 type Station struct {
-	Token         string
+	Authenticator Authenticator
 	Time          time.Time
 	Info          *base.ServerInfo
 	ChangeHandler func(string, int)
-
-	clientCount       int
-	clientCountChange chan int
+	// PresenceHandler queries the participants in a channel of the cluster by the token of the client and its cid,
+	// without it the cluster presence is the station presence.
+	PresenceHandler func(string, string, string) ([]*base.Presence, error)
+	AdminHandler    func(*base.Moderation) // reports the admin actions to the cluster, see Moderate
+	// queue policies of the participants, zero value blocks at default size
+	ClientQueue   base.QueuePolicy
+	RelayQueue    base.QueuePolicy
+	RecorderQueue base.QueuePolicy
+	HistorySize   int // count of latest signals kept for each channel for resuming clients
+	// patterns of channels delivered at least once to every client, clients opt in other channels by joining with reliable=1
+	ReliableChannels []string
+	MaxUnacked       int           // count of signals kept unacked for each reliable client
+	RequestTimeout   time.Duration // time of waiting for the reply of a request
+	// rate limits of signals published by each client, to each channel and to the station,
+	// the commands of clients count against the client and the station limits
+	ClientLimit  base.RateLimit
+	ChannelLimit base.RateLimit
+	StationLimit base.RateLimit
+	// a client sending a larger frame is disconnected, and so is a client over its rate limit more times
+	MaxFrameSize  int
+	MaxViolations int
+	// max count of channels, of clients in each channel and of clients in the station, a client over them is rejected
+	MaxChannels    int
+	MaxChannelSize int
+	MaxClients     int
+	Heartbeat      base.HeartbeatPolicy // heartbeat of the links, a timed out link is released as disconnected
+	Webhooks       []*Webhook           // notified of the lifecycle events of channels, clients, relays and recorders
+
+	clientCount       int64
+	draining          int32 // a draining station does not accept joins of clients and relays, nor publishes of clients
+	clients           map[string]*Client
+	clientsLocker     sync.RWMutex
 	broadcasted       map[string]time.Time
+	broadcastedLocker sync.Mutex
 	channels          map[string]*Channel
+	histories         map[string]*History
+	channelsLocker    sync.RWMutex
 	relays            map[string]*Relay
+	relaysLocker      sync.RWMutex
 	recorders         map[string]*Recorder
+	recordersLocker   sync.RWMutex
+	subscriptions     Subscriptions
+	unacked           map[string]*keptUnacked
+	published         map[string]time.Time
+	unackedLocker     sync.Mutex
 	relayLocker       sync.Mutex
+	limiter           *Limiter
+	violations        Violations
+	clientReceive     func(*websocket.Conn, interface{}) error
+	retained          map[string]*SignalPack // the retained signals and the states, see State, survive the close of channels
+	retainedLocker    sync.RWMutex
+	states            map[string]*State
+	statesLocker      sync.RWMutex
+	interceptors      []Interceptor // chain of the signals published by clients, see Interceptor
+	interceptorLocker sync.RWMutex
+	moderations       map[string]*base.Moderation
+	moderationsLocker sync.RWMutex
 	isTrunk           bool
+	clientCmdHandlers map[string]func(*Client, string) error
 }
 
-func (this *Station) InitWith(info *base.ServerInfo, token string) {
+func (this *Station) InitWith(info *base.ServerInfo, authenticator Authenticator) {
 	this.Info = info
-	this.Token = token
+	this.Authenticator = authenticator
+	if this.Authenticator == nil {
+		this.Authenticator = &AnonymousAuthenticator{}
+	}
 	this.isTrunk = info.Mode&base.STATION_MODE_TRUNK == base.STATION_MODE_TRUNK
+	this.clients = make(map[string]*Client)
 	this.channels = make(map[string]*Channel)
+	this.histories = make(map[string]*History)
+	this.retained = make(map[string]*SignalPack)
+	this.states = make(map[string]*State)
+	this.moderations = make(map[string]*base.Moderation)
+	if this.HistorySize <= 0 {
+		this.HistorySize = base.DEFAULT_HISTORY_SIZE
+	}
+	if this.MaxUnacked <= 0 {
+		this.MaxUnacked = base.DEFAULT_MAX_UNACKED
+	}
+	if this.RequestTimeout <= 0 {
+		this.RequestTimeout = base.DEFAULT_REQUEST_TIMEOUT
+	}
 	this.relays = make(map[string]*Relay)
 	this.recorders = make(map[string]*Recorder)
 	this.broadcasted = make(map[string]time.Time)
-	this.clientCountChange = make(chan int)
+	this.unacked = make(map[string]*keptUnacked)
+	this.published = make(map[string]time.Time)
+	this.subscriptions.Init()
+	this.limiter = NewLimiter(this.StationLimit)
+	this.clientReceive = limitedReceive(this.MaxFrameSize)
 	this.clientCount = 0
 	this.Time = time.Now()
+	this.registerClientCmdHandlers()
 
-	go this.listenClientCountChange()
 	go this.reduceBroadcasted()
+	go this.reduceHistories()
+	go this.reduceUnacked()
+	go this.reduceRetained()
+	go this.reduceStates()
 }
 
 func (this *Station) ClientJoin(ws *websocket.Conn) {
-	err, cid, pid := this.parseParams(ws)
+	if this.IsDraining() {
+		websocket.JSON.Send(ws, this.newError(base.ERROR_SHUTTINGDOWN))
+		return
+	}
+	err, cid, token := this.parseParams(ws)
+	if err != nil {
+		websocket.JSON.Send(ws, this.newError(err.Error()))
+		return
+	}
+	if base.IsChannelPattern(cid) {
+		websocket.JSON.Send(ws, this.newError("cid is a pattern, subscribe it by cmd"))
+		return
+	}
+	if err := this.admitClient(cid); err != nil {
+		log.Println("station - client: rejected:", cid, err)
+		websocket.JSON.Send(ws, this.newError(err.Error()))
+		return
+	}
+	identity, err := this.Authenticator.Authenticate(cid, token, ws.Request())
+	if err == nil && !identity.Can(cid, base.PERMISSION_PUBLISH) && !identity.Can(cid, base.PERMISSION_SUBSCRIBE) {
+		err = errors.New("no permission on channel")
+	}
+	if err != nil {
+		log.Println("station - client: rejected:", cid, err)
+		websocket.JSON.Send(ws, this.newError(err.Error()))
+		return
+	}
+	if remoteAddr := ws.Request().RemoteAddr; this.isModerated(base.MODERATION_BAN, cid, identity.PID+"_"+remoteAddr, identity.PID, hostOf(remoteAddr)) {
+		log.Println("station - client: banned:", cid, identity.PID)
+		websocket.JSON.Send(ws, this.newError(base.ERROR_BANNED))
+		return
+	}
+	from, err := this.parseResumePoint(ws)
 	if err != nil {
-		websocket.JSON.Send(ws, err)
+		websocket.JSON.Send(ws, this.newError(err.Error()))
 		return
 	}
 
-	channel := this.getChannel(cid)
-	this.initClient(ws, pid, channel)
+	params := &joinParams{
+		CID:      cid,
+		Token:    token,
+		From:     from,
+		Reliable: ws.Request().Form.Get("reliable") == "1",
+		Binary:   ws.Request().Form.Get("binary") == "1",
+	}
+	this.initClient(ws, identity, params)
 }
 
 func (this *Station) SetRecorders(remoteAddrs []string) {
@@ -68,6 +189,10 @@ func (this *Station) SetRecorders(remoteAddrs []string) {
 }
 
 func (this *Station) RelayJoin(ws *websocket.Conn) {
+	if this.IsDraining() {
+		ws.Close()
+		return
+	}
 	this.relayLocker.Lock()
 	flag, relay := this.relayJoin(ws)
 	this.relayLocker.Unlock()
@@ -77,6 +202,9 @@ func (this *Station) RelayJoin(ws *websocket.Conn) {
 }
 
 func (this *Station) RelayWithStation(remoteAddr string) {
+	if this.IsDraining() {
+		return
+	}
 	this.relayLocker.Lock()
 	flag, relay := this.relayWithStation(remoteAddr)
 	this.relayLocker.Unlock()
@@ -85,44 +213,77 @@ func (this *Station) RelayWithStation(remoteAddr string) {
 	}
 }
 
+// Broadcast broadcasts a signal from other stations to the channel that the signal belongs to.
+// If the channel is not in the station, the signal is sent to the clients those subscribed to a matching pattern,
+// and is relayed to other stations.
 func (this *Station) Broadcast(signal *SignalPack) {
-	if this.ExistsChannel(signal.CID) {
-		if this.IsBroadcasted(signal.Signal.ID) {
-			return
-		}
-		this.getChannel(signal.CID).Broadcast(signal)
-	} else {
-		go this.RelayToRemoteStations(signal)
-		go this.RecordSignal(signal)
+	if signal.Signal.IsExpired() || this.isStaleRetained(signal) || this.IsBroadcasted(signal.Signal.ID) {
+		return
 	}
+	if channel := this.channel(signal.CID); channel != nil {
+		channel.Broadcast(signal)
+		return
+	}
+	if !this.mergeState(signal) {
+		return
+	}
+	this.retain(signal)
+	if this.sendToSubscribers(signal) && signal.Signal.To != "" {
+		return
+	}
+	go this.relayToRemoteStations(signal)
+	go this.RecordSignal(signal)
 }
 
 func (this *Station) RelayToRemoteStations(signal *SignalPack) {
 	if this.IsBroadcasted(signal.Signal.ID) {
 		return
 	}
-	signal.Stations = append(signal.Stations, this.Info.Addr())
-	transLen := len(signal.Stations)
-	lastAddr := signal.Stations[transLen-1]
+	this.relayToRemoteStations(signal)
+}
 
-	for _, relay := range this.relays {
+// relayToRemoteStations pushes a copy of the signal with the station appended to its stations,
+// the signal itself is shared with other goroutines and is not modified.
+func (this *Station) relayToRemoteStations(signal *SignalPack) {
+	relayed := *signal
+	relayed.Stations = append(append([]string{}, signal.Stations...), this.Info.Addr())
+	transLen := len(relayed.Stations)
+	lastAddr := relayed.Stations[transLen-1]
+
+	for _, relay := range this.Relays() {
 		if transLen == 1 || relay.Info.Remote.IpAddr != lastAddr && (!this.isTrunk || !relay.RemoteIsTrunk) {
-			relay.PushSignal(signal)
+			relay.PushSignal(&relayed)
 		}
 	}
 }
 
 func (this *Station) RecordSignal(signal *SignalPack) {
-	for _, recorder := range this.recorders {
+	if signal.Signal.To != "" {
+		return
+	}
+	for _, recorder := range this.Recorders() {
 		recorder.PushSignal(signal)
 	}
 }
 
 func (this *Station) ClientCount() int {
-	return this.clientCount
+	return int(atomic.LoadInt64(&this.clientCount))
+}
+
+// Clients returns the clients connected to the station.
+func (this *Station) Clients() []*Client {
+	this.clientsLocker.RLock()
+	defer this.clientsLocker.RUnlock()
+	clients := []*Client{}
+	for _, client := range this.clients {
+		clients = append(clients, client)
+	}
+	return clients
 }
 
 func (this *Station) Channels() []*Channel {
+	this.channelsLocker.RLock()
+	defer this.channelsLocker.RUnlock()
 	channels := []*Channel{}
 	for _, channel := range this.channels {
 		channels = append(channels, channel)
@@ -131,6 +292,8 @@ func (this *Station) Channels() []*Channel {
 }
 
 func (this *Station) Relays() []*Relay {
+	this.relaysLocker.RLock()
+	defer this.relaysLocker.RUnlock()
 	relays := []*Relay{}
 	for _, relay := range this.relays {
 		relays = append(relays, relay)
@@ -139,6 +302,8 @@ func (this *Station) Relays() []*Relay {
 }
 
 func (this *Station) Recorders() []*Recorder {
+	this.recordersLocker.RLock()
+	defer this.recordersLocker.RUnlock()
 	recorders := []*Recorder{}
 	for _, recorder := range this.recorders {
 		recorders = append(recorders, recorder)
@@ -147,33 +312,76 @@ func (this *Station) Recorders() []*Recorder {
 }
 
 func (this *Station) ChannelCount() int {
+	this.channelsLocker.RLock()
+	defer this.channelsLocker.RUnlock()
 	return len(this.channels)
 }
 
 func (this *Station) RelayCount() int {
+	this.relaysLocker.RLock()
+	defer this.relaysLocker.RUnlock()
 	return len(this.relays)
 }
 
 func (this *Station) ChannelClientCount(cid string) int {
-	if this.channels[cid] != nil {
-		return this.channels[cid].ClientCount()
+	if channel := this.channel(cid); channel != nil {
+		return channel.ClientCount()
 	}
 	return 0
 }
 
+// Presences returns the participants in the channel of the station.
+func (this *Station) Presences(cid string) []*base.Presence {
+	if channel := this.channel(cid); channel != nil {
+		return channel.Presences()
+	}
+	return []*base.Presence{}
+}
+
+// ClusterPresences returns the participants in the channel of every station in the cluster,
+// the query is authenticated by the token issued for tokenCID.
+func (this *Station) ClusterPresences(cid string, tokenCID string, token string) ([]*base.Presence, error) {
+	if this.PresenceHandler == nil {
+		return this.Presences(cid), nil
+	}
+	return this.PresenceHandler(cid, tokenCID, token)
+}
+
+// IsReliableChannel returns true if the channel matches one of the reliable channel patterns.
+func (this *Station) IsReliableChannel(cid string) bool {
+	for _, pattern := range this.ReliableChannels {
+		if base.MatchChannel(pattern, cid) {
+			return true
+		}
+	}
+	return false
+}
+
+// SubscribedPatterns returns the channel patterns those the clients subscribed to.
+func (this *Station) SubscribedPatterns() []string {
+	return this.subscriptions.Patterns()
+}
+
 func (this *Station) BroadcastedCount() int {
+	this.broadcastedLocker.Lock()
+	defer this.broadcastedLocker.Unlock()
 	return len(this.broadcasted)
 }
 
 func (this *Station) GetRelayByUPID(upid string) *Relay {
+	this.relaysLocker.RLock()
+	defer this.relaysLocker.RUnlock()
 	return this.relays[upid]
 }
 
 func (this *Station) ExistsChannel(cid string) bool {
-	return this.channels[cid] != nil
+	return this.channel(cid) != nil
 }
 
+// IsBroadcasted returns true if the signal with the id has been broadcasted, otherwise marks it as broadcasted.
 func (this *Station) IsBroadcasted(id string) bool {
+	this.broadcastedLocker.Lock()
+	defer this.broadcastedLocker.Unlock()
 	if !this.broadcasted[id].IsZero() {
 		return true
 	}
@@ -184,38 +392,60 @@ func (this *Station) IsBroadcasted(id string) bool {
 func (this *Station) reduceBroadcasted() {
 	time.AfterFunc(base.STATION_BROADCASTED_CACHE_TIMEOUT, func() {
 		now := time.Now()
+		this.broadcastedLocker.Lock()
 		for id, time := range this.broadcasted {
 			if now.Sub(time) >= base.STATION_BROADCASTED_CACHE_TIMEOUT {
 				delete(this.broadcasted, id)
 			}
 		}
+		this.broadcastedLocker.Unlock()
 		this.reduceBroadcasted()
 	})
 }
 
-func (this *Station) listenClientCountChange() {
-	for {
-		select {
-		case clientCount := <-this.clientCountChange:
-			this.clientCount = this.clientCount + clientCount
+func (this *Station) reduceHistories() {
+	time.AfterFunc(base.STATION_HISTORY_TIMEOUT, func() {
+		now := time.Now()
+		this.channelsLocker.Lock()
+		for cid, history := range this.histories {
+			if this.channels[cid] == nil && now.Sub(history.UsedTime()) >= base.STATION_HISTORY_TIMEOUT {
+				delete(this.histories, cid)
+			}
 		}
-	}
+		this.channelsLocker.Unlock()
+		this.reduceHistories()
+	})
 }
 
+func (this *Station) channel(cid string) *Channel {
+	this.channelsLocker.RLock()
+	defer this.channelsLocker.RUnlock()
+	return this.channels[cid]
+}
+
+// getChannel returns the channel with the cid, opens it if it does not exist. channelsLocker must be held.
 func (this *Station) getChannel(cid string) *Channel {
 	var channel *Channel
 	if channel = this.channels[cid]; channel == nil {
+		history := this.histories[cid]
+		if history == nil {
+			history = NewHistory(cid, this.HistorySize)
+			this.histories[cid] = history
+		}
 		channel = &Channel{}
-		channel.InitWith(cid, this)
-		channel.BeforeBroadcastHandler = this.beforeBroadcastHandler
+		channel.InitWith(cid, this, history)
 		this.channels[cid] = channel
 		go channel.Run()
+		this.fireEvent(base.EVENT_CHANNELOPEN, cid, "")
 		log.Println("station - channel: opened:", cid)
 	}
 	return channel
 }
 
 func (this *Station) dialRecorder(remoteAddr string) {
+	if this.IsDraining() {
+		return
+	}
 	defer time.AfterFunc(base.STATION_TRY_RECONNECT_RECORDER_INTERVAL, func() {
 		this.dialRecorder(remoteAddr)
 	})
@@ -237,11 +467,15 @@ func (this *Station) startRecord(ws *websocket.Conn, remoteAddr string) {
 		return
 	}
 	upid := recorder.Info.UPID
+	this.recordersLocker.Lock()
 	this.recorders[upid] = recorder
+	this.recordersLocker.Unlock()
 	defer this.releaseRecorder(recorder)
 	this.fireParticipantChange(upid, base.ROUTECMDTYPE_RECORDERJOIN)
+	this.fireEvent(base.EVENT_RECORDERUP, upid, "")
 	log.Println("station - recorder: ready:", upid)
 	go recorder.StartListen()
+	go this.Heartbeat.Run(recorder.Info.closed, recorder.Info.Beat)
 	recorder.StartBroadcast()
 }
 
@@ -251,29 +485,27 @@ func (this *Station) createRecorder(ws *websocket.Conn, remoteAddr string) (*Rec
 		return nil, err
 	}
 	upid := this.createUPID(ws, remoteInfo.Addr())
-	info := ParticipantStruct{
-		UPID:    upid,
-		PID:     remoteAddr,
-		Remote:  &base.RemoteInfo{Conn: ws, IpAddr: remoteAddr},
-		Signals: make(chan *SignalPack, 100),
-	}
+	info := NewParticipantStruct(upid, remoteAddr, &base.RemoteInfo{Conn: ws, IpAddr: remoteAddr}, this.RecorderQueue)
 
 	recorder := &Recorder{
 		RemoteSID: remoteInfo.SID,
 		Info:      info,
 		Station:   this,
 		Time:      time.Now(),
+		codec:     NegotiateCodec(this.Info, remoteInfo),
 	}
 	return recorder, nil
 }
 
 func (this *Station) releaseRecorder(recorder *Recorder) {
 	upid := recorder.Info.UPID
-	this.recorders[upid] = nil
-	recorder.Release()
+	this.recordersLocker.Lock()
 	delete(this.recorders, upid)
+	this.recordersLocker.Unlock()
+	recorder.Release()
 	recorder = nil
 	this.fireParticipantChange(upid, base.ROUTECMDTYPE_RECORDERQUIT)
+	this.fireEvent(base.EVENT_RECORDERDOWN, upid, "")
 	log.Println("station - recorder: disconnected:", upid)
 }
 
@@ -327,12 +559,7 @@ func (this *Station) createUPID(ws *websocket.Conn, remoteAddr string) string {
 }
 
 func (this *Station) createRelay(ws *websocket.Conn, upid string, remoteInfo *base.ServerInfo, remoteAddr string) *Relay {
-	info := ParticipantStruct{
-		UPID:    upid,
-		PID:     remoteAddr,
-		Remote:  &base.RemoteInfo{Conn: ws, IpAddr: remoteAddr},
-		Signals: make(chan *SignalPack, 100),
-	}
+	info := NewParticipantStruct(upid, remoteAddr, &base.RemoteInfo{Conn: ws, IpAddr: remoteAddr}, this.RelayQueue)
 
 	relay := &Relay{
 		RemoteSID:     remoteInfo.SID,
@@ -342,31 +569,40 @@ func (this *Station) createRelay(ws *websocket.Conn, upid string, remoteInfo *ba
 		Station:       this,
 		IsRequester:   ws.IsClientConn(),
 		Time:          time.Now(),
+		codec:         NegotiateCodec(this.Info, remoteInfo),
 	}
+	this.relaysLocker.Lock()
 	this.relays[upid] = relay
+	this.relaysLocker.Unlock()
 	return relay
 }
 
 func (this *Station) startRelay(relay *Relay) {
 	defer this.releaseRelay(relay)
 	this.fireParticipantChange(relay.Info.UPID, base.ROUTECMDTYPE_RELAYJOIN)
+	this.fireEvent(base.EVENT_RELAYUP, relay.Info.UPID, "")
 	log.Println("station - relay: joined:", relay.Info.UPID)
 	go relay.StartListen()
+	go this.Heartbeat.Run(relay.Info.closed, relay.Info.Beat)
+	relay.PushSignals(this.RetainedSignals())
+	relay.PushSignals(this.stateSignals())
 	relay.StartBroadcast()
 }
 
 func (this *Station) releaseRelay(relay *Relay) {
 	upid := relay.Info.UPID
-	this.relays[upid] = nil
-	relay.Release()
+	this.relaysLocker.Lock()
 	delete(this.relays, upid)
+	this.relaysLocker.Unlock()
+	relay.Release()
 	relay = nil
 	this.fireParticipantChange(upid, base.ROUTECMDTYPE_RELAYQUIT)
+	this.fireEvent(base.EVENT_RELAYDOWN, upid, "")
 	log.Println("station - relay: quited:", upid)
 }
 
 func (this *Station) existsRelay(remoteAddr string) (bool, *Relay) {
-	for _, relay := range this.relays {
+	for _, relay := range this.Relays() {
 		if relay.Info.Remote.IpAddr == remoteAddr {
 			return true, relay
 		}
@@ -374,36 +610,201 @@ func (this *Station) existsRelay(remoteAddr string) (bool, *Relay) {
 	return false, nil
 }
 
-func (this *Station) initClient(ws *websocket.Conn, pid string, channel *Channel) {
-	client := this.clientJoin(ws, pid, channel)
-	defer this.clientQuit(client, channel)
+func (this *Station) initClient(ws *websocket.Conn, identity *Identity, params *joinParams) {
+	client, err := this.clientJoin(ws, identity, params)
+	if err != nil {
+		log.Println("station - client: rejected:", params.CID, err)
+		websocket.JSON.Send(ws, this.newError(err.Error()))
+		return
+	}
+	defer this.clientQuit(client)
 	client.StartBroadcast()
 }
 
-func (this *Station) clientJoin(ws *websocket.Conn, pid string, channel *Channel) *Client {
+// clientJoin adds the client to the station, it is rejected if the station has MaxClients already.
+func (this *Station) clientJoin(ws *websocket.Conn, identity *Identity, params *joinParams) (*Client, error) {
+	cid := params.CID
 	defer func() {
 		recover()
 	}()
+	pid := identity.PID
 	ipAddr := ws.Request().RemoteAddr
 	upid := pid + "_" + ipAddr
-	if client := channel.GetClientByUPID(upid); client != nil {
-		_ = client.Info.Remote.Conn.Close()
+	if channel := this.channel(cid); channel != nil {
+		if client := channel.GetClientByUPID(upid); client != nil {
+			_ = client.Info.Remote.Conn.Close()
+		}
+	}
+
+	info := NewParticipantStruct(upid, pid, &base.RemoteInfo{Conn: ws, IpAddr: ipAddr}, this.ClientQueue)
+
+	client := &Client{
+		Info:     info,
+		Station:  this,
+		CID:      cid,
+		Identity: identity,
+		token:    params.Token,
+		Reliable: params.Reliable,
+		Binary:   params.Binary,
+		limiter:  NewLimiter(this.ClientLimit),
+		channels: make(map[string]*Channel),
+		patterns: make(map[string]bool),
 	}
+	client.unacked.Init(this.MaxUnacked)
+	client.requests.Init()
 
-	info := ParticipantStruct{
-		UPID:    upid,
-		PID:     pid,
-		Remote:  &base.RemoteInfo{Conn: ws, IpAddr: ipAddr},
-		Signals: make(chan *SignalPack, 100),
+	this.clientsLocker.Lock()
+	if _, exists := this.clients[upid]; !exists && this.MaxClients > 0 && len(this.clients) >= this.MaxClients {
+		this.clientsLocker.Unlock()
+		return nil, errors.New(base.ERROR_STATIONFULL)
 	}
+	this.clients[upid] = client
+	this.clientsLocker.Unlock()
+	atomic.AddInt64(&this.clientCount, 1)
+	this.fireParticipantChange(upid, base.ROUTECMDTYPE_CLIENTJOIN)
+	this.fireEvent(base.EVENT_CLIENTJOIN, upid, pid)
+	log.Println("station - client: joined:", pid)
+
+	go client.StartListen()
+	go client.redeliver()
+	go this.Heartbeat.Run(client.Info.closed, client.Info.Beat)
 
-	client := &Client{Info: info, Channel: channel}
+	if params.From != nil {
+		this.resumeChannel(client, cid, params.Token, *params.From)
+	} else if err := this.joinChannel(client, cid); err != nil {
+		client.pushError(cid, err.Error())
+	}
+	return client, nil
+}
 
+func (this *Station) clientQuit(client *Client) {
+	// closed first, so that the channels being left do not block on pushing to it
+	client.Close()
+	for _, channel := range client.Channels() {
+		this.leaveChannel(client, channel)
+	}
+	for _, pattern := range client.Patterns() {
+		this.unsubscribePattern(client, pattern)
+	}
+	this.keepUnacked(client)
+	this.clientsLocker.Lock()
+	if this.clients[client.Info.UPID] == client {
+		delete(this.clients, client.Info.UPID)
+	}
+	this.clientsLocker.Unlock()
+	atomic.AddInt64(&this.clientCount, -1)
+	this.fireParticipantChange(client.Info.UPID, base.ROUTECMDTYPE_CLIENTQUIT)
+	this.fireEvent(base.EVENT_CLIENTQUIT, client.Info.UPID, client.Info.PID)
+	log.Println("station - client: quitted:", client.Info.PID)
+}
+
+func (this *Station) joinChannel(client *Client, cid string) error {
+	this.channelsLocker.Lock()
+	if err := this.admit(cid); err != nil {
+		this.channelsLocker.Unlock()
+		return err
+	}
+	channel := this.getChannel(cid)
 	channel.ClientJoin(client)
+	this.channelsLocker.Unlock()
+	this.joinedChannel(client, channel)
+	return nil
+}
 
-	log.Println("station - client: joined in:", pid)
+// resumeChannel joins the client in the channel, and replays the signals after the resume point to it before the live signals.
+// Signals too old for the history of the channel are fetched from the recorders, it works with the resume point by id only.
+// The client receives a gap error and joins without replay if the signals are not available either.
+// A sequence numbered by another station or by an earlier history of the channel is a gap too.
+func (this *Station) resumeChannel(client *Client, cid string, token string, from resumePoint) {
+	var channel *Channel
+	var resumed bool
+	var err error
+	channel, resumed, err = this.resumeFromHistory(client, cid, from)
+	if err == nil && !resumed && from.ID != "" {
+		if signals, err := this.fetchRecorded(cid, token, from.ID); err == nil {
+			for _, signal := range signals {
+				signal.Seq = 0
+				signal.SeqSID = ""
+				client.replaySignal(&SignalPack{Signal: *signal, CID: cid, Time: time.Now(), Stations: []string{}})
+			}
+			if len(signals) > 0 {
+				from.ID = signals[len(signals)-1].ID
+			}
+			channel, resumed, err = this.resumeFromHistory(client, cid, from)
+		}
+	}
+	if err != nil {
+		client.pushError(cid, err.Error())
+		return
+	}
+	if !resumed {
+		log.Println("station - client: resume gap:", client.Info.PID, cid)
+		client.pushError(cid, base.ERROR_GAP)
+		if err := this.joinChannel(client, cid); err != nil {
+			client.pushError(cid, err.Error())
+		}
+		return
+	}
+	this.joinedChannel(client, channel)
+}
 
-	go client.StartListen()
+// resumeFromHistory returns an error if the client is over the limits of the station.
+// The client counts against the size of the channel from its admission, while the signals are replayed to it.
+func (this *Station) resumeFromHistory(client *Client, cid string, from resumePoint) (*Channel, bool, error) {
+	for {
+		this.channelsLocker.Lock()
+		if err := this.admit(cid); err != nil {
+			this.channelsLocker.Unlock()
+			return nil, false, err
+		}
+		channel := this.getChannel(cid)
+		channel.admitResuming()
+		this.channelsLocker.Unlock()
+		resumed, err := channel.Resume(client, from)
+		channel.resumed()
+		if err == nil {
+			return channel, resumed, nil
+		}
+		if client.Info.IsClosed() {
+			return nil, false, err
+		}
+	}
+}
+
+// fetchRecorded fetches the signals after the signal with the id from the recorders.
+func (this *Station) fetchRecorded(cid string, token string, lastID string) ([]*Signal, error) {
+	err := errors.New("no recorder")
+	for _, recorder := range this.Recorders() {
+		query := url.Values{"cid": {cid}, "token": {token}, "lastid": {lastID}}
+		uri := base.WEBSOCKET_PREFIX + recorder.Info.PID + base.RECORDER_FETCH_PATH + "?" + query.Encode()
+		var ws *websocket.Conn
+		if ws, err = websocket.Dial(uri, "", "http://localhost/"); err != nil {
+			continue
+		}
+		var signals []*Signal
+		err = websocket.JSON.Receive(ws, &signals)
+		ws.Close()
+		if err != nil {
+			continue
+		}
+		if len(signals) > 0 && signals[0].Type == base.SIGNALTYPE_ERROR {
+			err = errors.New(signals[0].Text)
+			continue
+		}
+		return signals, nil
+	}
+	return nil, err
+}
+
+// joinedChannel announces the client that has been added to the channel.
+func (this *Station) joinedChannel(client *Client, channel *Channel) {
+	client.setChannel(channel)
+	if client.IsReliable(channel.CID) {
+		client.PushSignals(this.takeUnacked(client.Info.PID, channel.CID))
+	}
+	this.fireChannelChange(channel.Presence(client.Info.UPID), base.ROUTECMDTYPE_CHANNELJOIN)
+
+	log.Println("station - client: joined in:", client.Info.PID, channel.CID)
 
 	signalPack := SignalPack{
 		CID:      channel.CID,
@@ -414,15 +815,17 @@ func (this *Station) clientJoin(ws *websocket.Conn, pid string, channel *Channel
 		ID:   uuid.New(),
 		PID:  client.Info.UPID,
 		Type: base.SIGNALTYPE_PJOIN,
-		Text: strconv.Itoa(len(channel.Clients())),
+		Text: strconv.Itoa(channel.ClientCount()),
 	}
 	channel.Broadcast(&signalPack)
-	return client
+	this.sendRetained(client, channel)
+	this.sendState(client, channel)
 }
 
-func (this *Station) clientQuit(client *Client, channel *Channel) {
+func (this *Station) leaveChannel(client *Client, channel *Channel) {
+	this.fireChannelChange(channel.Presence(client.Info.UPID), base.ROUTECMDTYPE_CHANNELQUIT)
 	channel.ClientQuit(client)
-	client.Close()
+	client.removeChannel(channel.CID)
 
 	signalPack := SignalPack{
 		CID:      channel.CID,
@@ -433,31 +836,83 @@ func (this *Station) clientQuit(client *Client, channel *Channel) {
 		ID:   uuid.New(),
 		PID:  client.Info.UPID,
 		Type: base.SIGNALTYPE_PQUIT,
-		Text: strconv.Itoa(len(channel.Clients())),
+		Text: strconv.Itoa(channel.ClientCount()),
 	}
-	log.Println("station - client: quitted:", client.Info.PID)
+	log.Println("station - client: quitted from:", client.Info.PID, channel.CID)
 	channel.Broadcast(&signalPack)
 
-	if len(channel.Clients()) == 0 {
-		this.releaseChannel(channel)
+	if channel.ClientCount() == 0 {
+		go this.releaseChannel(channel)
 	}
 }
 
+func (this *Station) subscribePattern(client *Client, pattern string) {
+	this.subscriptions.Subscribe(pattern, client)
+	client.setPattern(pattern, true)
+	log.Println("station - client: subscribed:", client.Info.PID, pattern)
+}
+
+func (this *Station) unsubscribePattern(client *Client, pattern string) {
+	this.subscriptions.Unsubscribe(pattern, client)
+	client.setPattern(pattern, false)
+	log.Println("station - client: unsubscribed:", client.Info.PID, pattern)
+}
+
+// sendToSubscribers sends the signal to the clients those subscribed to a pattern matching the cid of the signal,
+// clients joined in the channel are skipped as the channel sends the signal to them, and clients banned from the channel too.
+// A unicast signal is sent to the target client only. It returns true if any target client is found.
+func (this *Station) sendToSubscribers(signal *SignalPack) bool {
+	delivered := false
+	for _, client := range this.subscriptions.Match(signal.CID) {
+		if client.InChannel(signal.CID) || this.isBanned(signal.CID, client) {
+			continue
+		}
+		if signal.Signal.To != "" && client.Info.PID != signal.Signal.To && client.Info.UPID != signal.Signal.To {
+			continue
+		}
+		delivered = true
+		if client.Identity.Can(signal.CID, base.PERMISSION_SUBSCRIBE) {
+			client.PushSignal(signal)
+		}
+	}
+	return delivered
+}
+
 func (this *Station) releaseChannel(channel *Channel) {
 	time.Sleep(500 * time.Millisecond)
-	if len(channel.Clients()) == 0 {
+	this.channelsLocker.Lock()
+	defer this.channelsLocker.Unlock()
+	if channel.admittedCount() == 0 && this.channels[channel.CID] == channel {
 		delete(this.channels, channel.CID)
 		channel.Close()
+		this.fireEvent(base.EVENT_CHANNELCLOSE, channel.CID, "")
 		log.Println("station - channel: closed:", channel.CID)
 	}
 }
 
+// fireParticipantChange reports the change in the order it happens, ChangeHandler must not block.
 func (this *Station) fireParticipantChange(upid string, cmdType int) {
-	go func(upid string, cmdType int) {
-		if this.ChangeHandler != nil {
-			this.ChangeHandler(upid, cmdType)
-		}
-	}(upid, cmdType)
+	if this.ChangeHandler != nil {
+		this.ChangeHandler(upid, cmdType)
+	}
+}
+
+func (this *Station) fireChannelChange(presence *base.Presence, cmdType int) {
+	if presence == nil {
+		return
+	}
+	if text, err := json.Marshal(presence); err == nil {
+		this.fireParticipantChange(string(text), cmdType)
+	}
+}
+
+// joinParams is the parameters of a client joining in the station.
+type joinParams struct {
+	CID      string
+	Token    string
+	From     *resumePoint
+	Reliable bool
+	Binary   bool
 }
 
 func (this *Station) parseParams(ws *websocket.Conn) (error, string, string) {
@@ -469,24 +924,25 @@ func (this *Station) parseParams(ws *websocket.Conn) (error, string, string) {
 		return errors.New("no cid"), "", ""
 	}
 
-	if token = request.Form.Get("token"); token == "" {
-		return errors.New("no token"), "", ""
-	}
+	token = request.Form.Get("token")
 	return nil, channelid, token
 }
 
-func (this *Station) beforeBroadcastHandler(channel *Channel, signal *SignalPack) bool {
-	if signal.Signal.Type == base.SIGNALTYPE_PJOIN {
-		if len(signal.Stations) == 0 {
-			this.clientCountChange <- 1
-			this.fireParticipantChange(signal.Signal.PID, base.ROUTECMDTYPE_CLIENTJOIN)
-		}
+func (this *Station) parseResumePoint(ws *websocket.Conn) (*resumePoint, error) {
+	request := ws.Request()
+	if id := request.Form.Get("lastid"); id != "" {
+		return &resumePoint{ID: id}, nil
 	}
-	if signal.Signal.Type == base.SIGNALTYPE_PQUIT {
-		if len(signal.Stations) == 0 {
-			this.clientCountChange <- -1
-			this.fireParticipantChange(signal.Signal.PID, base.ROUTECMDTYPE_CLIENTQUIT)
+	if seq := request.Form.Get("lastseq"); seq != "" {
+		value, err := strconv.ParseUint(seq, 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid lastseq")
 		}
+		return &resumePoint{Seq: value, SID: request.Form.Get("lastsid")}, nil
 	}
-	return true
+	return nil, nil
+}
+
+func (this *Station) newError(text string) *Signal {
+	return &Signal{Type: base.SIGNALTYPE_ERROR, Text: text}
 }
@@ -0,0 +1,1121 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"code.google.com/p/go.net/websocket"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"saassoft.net/signaldistribution/base"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+// testStation is a station serving clients and relays on a local http server.
+type testStation struct {
+	*Station
+	server *httptest.Server
+	addr   string
+}
+
+// newTestStation starts a trunk station, setup is called before the station is initialized.
+// The queues drop the oldest signals, as the config does by default.
+func newTestStation(t *testing.T, sid string, setup func(*Station)) *testStation {
+	station := &Station{
+		ClientQueue: base.QueuePolicy{Overflow: base.OVERFLOW_DROPOLDEST},
+		RelayQueue:  base.QueuePolicy{Overflow: base.OVERFLOW_DROPOLDEST},
+	}
+	mux := http.NewServeMux()
+	mux.Handle(base.STATION_CLIENT_JOIN_PATH, websocket.Handler(station.ClientJoin))
+	mux.Handle(base.STATION_RELAY_JOIN_PATH, websocket.Handler(station.RelayJoin))
+	server := httptest.NewServer(mux)
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNumber, _ := strconv.Atoi(port)
+	if setup != nil {
+		setup(station)
+	}
+	station.InitWith(&base.ServerInfo{SID: sid, IP: host, Port: portNumber, Mode: base.STATION_MODE_TRUNK}, nil)
+	return &testStation{Station: station, server: server, addr: server.Listener.Addr().String()}
+}
+
+func (this *testStation) Close() {
+	this.Station.Close()
+	this.server.Close()
+}
+
+// dial connects a client to the station, query is the join parameters.
+func (this *testStation) dial(t *testing.T, query url.Values) *websocket.Conn {
+	ws, err := this.dialClient(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+// dialClient is dial for goroutines other than the test, it returns the error instead of failing.
+func (this *testStation) dialClient(query url.Values) (*websocket.Conn, error) {
+	return websocket.Dial("ws://"+this.addr+base.STATION_CLIENT_JOIN_PATH+"?"+query.Encode(), "", "http://localhost/")
+}
+
+// join connects a client with the pid to the channel and waits until it is in the channel.
+func (this *testStation) join(t *testing.T, cid string, pid string) *websocket.Conn {
+	ws, err := this.joinClient(cid, pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+// joinClient is join for goroutines other than the test, it returns the error instead of failing.
+func (this *testStation) joinClient(cid string, pid string) (*websocket.Conn, error) {
+	ws, err := this.dialClient(url.Values{"cid": {cid}, "token": {pid}})
+	if err != nil {
+		return nil, err
+	}
+	_, err = receiveSignal(ws, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_PJOIN && strings.HasPrefix(signal.PID, pid+"_")
+	})
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// receiveUntil receives the signals from the station until match returns true, it fails on timeout.
+func receiveUntil(t *testing.T, ws *websocket.Conn, match func(*Signal) bool) *Signal {
+	signal, err := receiveSignal(ws, match)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signal
+}
+
+// receiveSignal is receiveUntil for goroutines other than the test, it returns the error instead of failing.
+func receiveSignal(ws *websocket.Conn, match func(*Signal) bool) (*Signal, error) {
+	deadline := time.Now().Add(5 * time.Second)
+	ws.SetReadDeadline(deadline)
+	defer ws.SetReadDeadline(time.Time{})
+	for {
+		var signal Signal
+		if err := JSONCodec.Receive(ws, &signal); err != nil {
+			return nil, errors.New("no expected signal: " + err.Error())
+		}
+		if match(&signal) {
+			return &signal, nil
+		}
+	}
+}
+
+// publish sends the signal to the station, it fails on error.
+// Goroutines other than the test send by JSONCodec.Send, and report the error by t.Error.
+func publish(t *testing.T, ws *websocket.Conn, signal *Signal) {
+	if err := JSONCodec.Send(ws, signal); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor waits until done returns true, it fails on timeout.
+func waitFor(t *testing.T, what string, done func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestConcurrentJoinQuitAndBroadcast joins, subscribes, publishes and quits many clients at once,
+// while the state of the station is read from other goroutines.
+func TestConcurrentJoinQuitAndBroadcast(t *testing.T) {
+	station := newTestStation(t, "s1", nil)
+	defer station.Close()
+
+	stop := make(chan bool)
+	readers := sync.WaitGroup{}
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for _, channel := range station.Channels() {
+				channel.Presences()
+				station.Presences(channel.CID)
+			}
+			station.Clients()
+			station.ChannelCount()
+			station.BroadcastedCount()
+			station.Capacity()
+		}
+	}()
+
+	clients := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		clients.Add(1)
+		go func(i int) {
+			defer clients.Done()
+			for round := 0; round < 5; round++ {
+				if err := churnClient(station, "p"+strconv.Itoa(i), i+round); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	clients.Wait()
+	close(stop)
+	readers.Wait()
+
+	waitFor(t, "clients to quit", func() bool {
+		return station.ClientCount() == 0
+	})
+	waitFor(t, "channels to close", func() bool {
+		return station.ChannelCount() == 0
+	})
+	if patterns := station.SubscribedPatterns(); len(patterns) != 0 {
+		t.Fatal("patterns left:", patterns)
+	}
+}
+
+// churnClient joins a client in one of three channels by n, subscribes to another and to all of them,
+// publishes and quits once it receives its own signals.
+func churnClient(station *testStation, pid string, n int) error {
+	ws, err := station.joinClient("room."+strconv.Itoa(n%3), pid)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+	signals := []*Signal{
+		&Signal{Type: base.SIGNALTYPE_CMD, Text: base.CLIENTCMD_SUBSCRIBE + ":room." + strconv.Itoa((n+1)%3)},
+		&Signal{Type: base.SIGNALTYPE_CMD, Text: base.CLIENTCMD_SUBSCRIBE + ":room.>"},
+	}
+	for i := 0; i < 5; i++ {
+		signals = append(signals, &Signal{Type: base.SIGNALTYPE_SIGNAL, Text: pid + "-" + strconv.Itoa(i)})
+	}
+	for _, signal := range signals {
+		if err := JSONCodec.Send(ws, signal); err != nil {
+			return err
+		}
+	}
+	last := pid + "-4"
+	_, err = receiveSignal(ws, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_SIGNAL && signal.Text == last
+	})
+	return err
+}
+
+// TestRelayChurn connects and disconnects the relay between two stations repeatedly while clients publish on both,
+// a signal published on one station reaches the clients of the other while the relay is up.
+func TestRelayChurn(t *testing.T) {
+	a := newTestStation(t, "a", nil)
+	defer a.Close()
+	b := newTestStation(t, "b", nil)
+	defer b.Close()
+
+	stop := make(chan bool)
+	publishers := sync.WaitGroup{}
+	for _, station := range []*testStation{a, b} {
+		publishers.Add(1)
+		go func(station *testStation) {
+			defer publishers.Done()
+			ws, err := station.joinClient("room", "publisher-"+station.Info.SID)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer ws.Close()
+			go func() {
+				var signal Signal
+				for JSONCodec.Receive(ws, &signal) == nil {
+				}
+			}()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := JSONCodec.Send(ws, &Signal{Type: base.SIGNALTYPE_SIGNAL, Text: "noise-" + strconv.Itoa(n)}); err != nil {
+					t.Error(err)
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(station)
+	}
+
+	receiver := b.join(t, "room", "receiver")
+	defer receiver.Close()
+	sender := a.join(t, "room", "sender")
+	defer sender.Close()
+
+	for round := 0; round < 10; round++ {
+		go b.RelayWithStation(a.addr)
+		waitFor(t, "relay to join", func() bool {
+			return a.RelayCount() == 1 && b.RelayCount() == 1
+		})
+		text := "round-" + strconv.Itoa(round)
+		publish(t, sender, &Signal{Type: base.SIGNALTYPE_SIGNAL, Text: text})
+		receiveUntil(t, receiver, func(signal *Signal) bool {
+			return signal.Type == base.SIGNALTYPE_SIGNAL && signal.Text == text
+		})
+		for _, relay := range b.Relays() {
+			relay.Info.Close()
+		}
+		waitFor(t, "relay to quit", func() bool {
+			return a.RelayCount() == 0 && b.RelayCount() == 0
+		})
+	}
+	close(stop)
+	publishers.Wait()
+}
+
+// TestConcurrentBroadcastKeepsOrder broadcasts from many goroutines, every client receives the signals in the same order.
+func TestConcurrentBroadcastKeepsOrder(t *testing.T) {
+	station := newTestStation(t, "s1", nil)
+	defer station.Close()
+
+	receivers := []*websocket.Conn{}
+	for i := 0; i < 3; i++ {
+		ws := station.join(t, "room", "r"+strconv.Itoa(i))
+		defer ws.Close()
+		receivers = append(receivers, ws)
+	}
+	publishers := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		publishers.Add(1)
+		go func(i int) {
+			defer publishers.Done()
+			for n := 0; n < 10; n++ {
+				station.Broadcast(&SignalPack{
+					Signal:   Signal{ID: "s" + strconv.Itoa(i) + "-" + strconv.Itoa(n), Type: base.SIGNALTYPE_SIGNAL, Text: "x"},
+					CID:      "room",
+					Time:     time.Now(),
+					Stations: []string{"remote"},
+				})
+			}
+		}(i)
+	}
+	publishers.Wait()
+
+	var first []string
+	for _, ws := range receivers {
+		ids := []string{}
+		var seq uint64
+		for len(ids) < 50 {
+			signal := receiveUntil(t, ws, func(signal *Signal) bool {
+				return signal.Type == base.SIGNALTYPE_SIGNAL
+			})
+			if signal.Seq <= seq {
+				t.Fatal("sequence does not increase:", seq, signal.Seq)
+			}
+			seq = signal.Seq
+			ids = append(ids, signal.ID)
+		}
+		if first == nil {
+			first = ids
+			continue
+		}
+		for i := range ids {
+			if ids[i] != first[i] {
+				t.Fatal("clients receive signals in different orders")
+			}
+		}
+	}
+}
+
+// TestClientCanNotPublishSystemSignals publishes a forged state signal, it is rejected and the state is not changed.
+func TestClientCanNotPublishSystemSignals(t *testing.T) {
+	station := newTestStation(t, "s1", nil)
+	defer station.Close()
+
+	ws := station.join(t, "room", "p")
+	defer ws.Close()
+	publish(t, ws, &Signal{Type: base.SIGNALTYPE_STATE, Text: `[{"Key":"owner","Value":"p"}]`})
+	receiveUntil(t, ws, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_ERROR
+	})
+	if state := station.State("room"); state != nil && len(state.Snapshot(true)) != 0 {
+		t.Fatal("state changed by a client signal:", state.Snapshot(true))
+	}
+}
+
+// TestStalledClientDoesNotBlockChannel fills up the queue of a client that never reads,
+// the other clients of the channel still receive the signals.
+func TestStalledClientDoesNotBlockChannel(t *testing.T) {
+	station := newTestStation(t, "s1", nil)
+	defer station.Close()
+
+	stalled := station.join(t, "room", "stalled")
+	defer stalled.Close()
+	live := station.join(t, "room", "live")
+	defer live.Close()
+
+	go func() {
+		text := strings.Repeat("x", 64*1024)
+		for n := 0; n < 1000; n++ {
+			id := strconv.Itoa(n)
+			if n == 999 {
+				id = "last"
+			}
+			station.Broadcast(&SignalPack{
+				Signal:   Signal{ID: id, Type: base.SIGNALTYPE_SIGNAL, Text: text},
+				CID:      "room",
+				Time:     time.Now(),
+				Stations: []string{"remote"},
+			})
+		}
+	}()
+	receiveUntil(t, live, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_SIGNAL && signal.ID == "last"
+	})
+	for _, client := range station.Clients() {
+		if client.Info.PID == "stalled" && client.Info.DroppedCount() == 0 {
+			t.Fatal("no signal dropped for the stalled client")
+		}
+	}
+}
+
+// TestReliableSignalsKeptWhenQueued overflows the queue of a reliable client that never reads and then quits,
+// every signal, including those dropped from or left in the queue, is kept for redelivery.
+func TestReliableSignalsKeptWhenQueued(t *testing.T) {
+	station := newTestStation(t, "s1", func(station *Station) {
+		station.ClientQueue = base.QueuePolicy{Size: 10, Overflow: base.OVERFLOW_DROPOLDEST}
+	})
+	defer station.Close()
+
+	ws := station.dial(t, url.Values{"cid": {"room"}, "token": {"p"}, "reliable": {"1"}})
+	receiveUntil(t, ws, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_PJOIN
+	})
+	text := strings.Repeat("x", 64*1024)
+	for n := 0; n < 400; n++ {
+		station.Broadcast(&SignalPack{
+			Signal:   Signal{ID: strconv.Itoa(n), Type: base.SIGNALTYPE_SIGNAL, Text: text},
+			CID:      "room",
+			Time:     time.Now(),
+			Stations: []string{"remote"},
+		})
+	}
+	waitFor(t, "signals to be dropped", func() bool {
+		for _, client := range station.Clients() {
+			if client.Info.DroppedCount() > 0 {
+				return true
+			}
+		}
+		return false
+	})
+	ws.Close()
+	waitFor(t, "client to quit", func() bool {
+		return station.ClientCount() == 0
+	})
+
+	kept := map[string]bool{}
+	for _, signal := range station.takeUnacked("p", "room") {
+		kept[signal.Signal.ID] = true
+	}
+	if len(kept) != 400 {
+		t.Fatal("kept signals:", len(kept))
+	}
+}
+
+// TestClientOverMaxUnackedIsDisconnected pushes more signals than MaxUnacked to a reliable client that never acks,
+// the client is disconnected and the unacked signals are redelivered when it reconnects.
+func TestClientOverMaxUnackedIsDisconnected(t *testing.T) {
+	station := newTestStation(t, "s1", func(station *Station) {
+		station.MaxUnacked = 5
+	})
+	defer station.Close()
+
+	ws := station.dial(t, url.Values{"cid": {"room"}, "token": {"p"}, "reliable": {"1"}})
+	defer ws.Close()
+	receiveUntil(t, ws, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_PJOIN
+	})
+	for n := 0; n < 6; n++ {
+		station.Broadcast(&SignalPack{
+			Signal:   Signal{ID: strconv.Itoa(n), Type: base.SIGNALTYPE_SIGNAL, Text: "x"},
+			CID:      "room",
+			Time:     time.Now(),
+			Stations: []string{"remote"},
+		})
+	}
+	waitFor(t, "client to be disconnected", func() bool {
+		return station.ClientCount() == 0
+	})
+
+	ws = station.dial(t, url.Values{"cid": {"room"}, "token": {"p"}, "reliable": {"1"}})
+	defer ws.Close()
+	redelivered := map[string]bool{}
+	receiveUntil(t, ws, func(signal *Signal) bool {
+		if signal.Type == base.SIGNALTYPE_SIGNAL {
+			redelivered[signal.ID] = true
+		}
+		return len(redelivered) == 5
+	})
+	for n := 0; n < 5; n++ {
+		if !redelivered[strconv.Itoa(n)] {
+			t.Fatal("signals redelivered:", redelivered)
+		}
+	}
+}
+
+// TestUnicastReachesTheTargetOnly sends a signal to one client of the channel and then broadcasts one,
+// the target receives the unicast, and the other client receives the broadcast only.
+func TestUnicastReachesTheTargetOnly(t *testing.T) {
+	station := newTestStation(t, "s1", nil)
+	defer station.Close()
+
+	sender := station.join(t, "room", "sender")
+	defer sender.Close()
+	target := station.join(t, "room", "target")
+	defer target.Close()
+	other := station.join(t, "room", "other")
+	defer other.Close()
+	publish(t, sender, &Signal{Type: base.SIGNALTYPE_SIGNAL, To: "target", Text: "unicast"})
+	publish(t, sender, &Signal{Type: base.SIGNALTYPE_SIGNAL, Text: "broadcast"})
+
+	receiveUntil(t, target, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_SIGNAL && signal.Text == "unicast"
+	})
+	signal := receiveUntil(t, other, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_SIGNAL
+	})
+	if signal.Text != "broadcast" {
+		t.Fatal("other client received:", signal.Text)
+	}
+}
+
+// TestUnicastReachesRemoteTarget sends a signal to a client connected to the other station,
+// it is relayed and delivered to the target only.
+func TestUnicastReachesRemoteTarget(t *testing.T) {
+	a := newTestStation(t, "a", nil)
+	defer a.Close()
+	b := newTestStation(t, "b", nil)
+	defer b.Close()
+	go b.RelayWithStation(a.addr)
+	waitFor(t, "relay to join", func() bool {
+		return a.RelayCount() == 1 && b.RelayCount() == 1
+	})
+
+	sender := a.join(t, "room", "sender")
+	defer sender.Close()
+	target := b.join(t, "room", "target")
+	defer target.Close()
+	other := b.join(t, "room", "other")
+	defer other.Close()
+	publish(t, sender, &Signal{Type: base.SIGNALTYPE_SIGNAL, To: "target", Text: "unicast"})
+	publish(t, sender, &Signal{Type: base.SIGNALTYPE_SIGNAL, Text: "broadcast"})
+
+	receiveUntil(t, target, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_SIGNAL && signal.Text == "unicast"
+	})
+	signal := receiveUntil(t, other, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_SIGNAL
+	})
+	if signal.Text != "broadcast" {
+		t.Fatal("other client received:", signal.Text)
+	}
+}
+
+// TestSystemHeadersAreSetByStation publishes a signal with forged system headers, they are replaced by those of the station,
+// the other headers are delivered unchanged to the local and the remote subscribers.
+func TestSystemHeadersAreSetByStation(t *testing.T) {
+	a := newTestStation(t, "a", nil)
+	defer a.Close()
+	b := newTestStation(t, "b", nil)
+	defer b.Close()
+	go b.RelayWithStation(a.addr)
+	waitFor(t, "relay to join", func() bool {
+		return a.RelayCount() == 1 && b.RelayCount() == 1
+	})
+
+	sender := a.join(t, "room", "sender")
+	defer sender.Close()
+	local := a.join(t, "room", "local")
+	defer local.Close()
+	remote := b.join(t, "room", "remote")
+	defer remote.Close()
+	headers := map[string]string{base.HEADER_ORIGIN_SID: "forged", base.HEADER_SYSTEM_PREFIX + "other": "forged", "trace": "t1"}
+	publish(t, sender, &Signal{Type: base.SIGNALTYPE_SIGNAL, Text: "headers", Headers: headers})
+
+	for _, ws := range []*websocket.Conn{local, remote} {
+		signal := receiveUntil(t, ws, func(signal *Signal) bool {
+			return signal.Type == base.SIGNALTYPE_SIGNAL && signal.Text == "headers"
+		})
+		if signal.Headers["trace"] != "t1" || signal.Headers[base.HEADER_ORIGIN_SID] != "a" || signal.Headers[base.HEADER_SYSTEM_PREFIX+"other"] != "" {
+			t.Fatal("headers not set by the station:", signal.Headers)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, signal.Headers[base.HEADER_RECEIVE_TIME]); err != nil {
+			t.Fatal("bad receive time:", err)
+		}
+	}
+}
+
+// TestSilentClientIsReleased sends blank signals from one client only, the silent client is released after the read timeout,
+// the relay between the stations is kept by the heartbeats.
+func TestSilentClientIsReleased(t *testing.T) {
+	heartbeat := func(station *Station) {
+		station.Heartbeat = base.HeartbeatPolicy{Interval: 50 * time.Millisecond, Timeout: 300 * time.Millisecond}
+	}
+	a := newTestStation(t, "a", heartbeat)
+	defer a.Close()
+	b := newTestStation(t, "b", heartbeat)
+	defer b.Close()
+	go b.RelayWithStation(a.addr)
+	waitFor(t, "relay to join", func() bool {
+		return a.RelayCount() == 1 && b.RelayCount() == 1
+	})
+
+	silent := a.join(t, "room", "silent")
+	defer silent.Close()
+	beating := a.join(t, "room", "beating")
+	defer beating.Close()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		publish(t, beating, &Signal{Type: base.SIGNALTYPE_BLANK})
+		time.Sleep(50 * time.Millisecond)
+	}
+	if count := a.ClientCount(); count != 1 {
+		t.Fatal("clients after the read timeout:", count)
+	}
+	if a.RelayCount() != 1 || b.RelayCount() != 1 {
+		t.Fatal("relay released with heartbeats")
+	}
+}
+
+// TestBannedSubscriberReceivesNothing bans a client subscribed to a pattern from one of the matching channels,
+// it receives the signals of the other matching channels only.
+func TestBannedSubscriberReceivesNothing(t *testing.T) {
+	station := newTestStation(t, "s1", nil)
+	defer station.Close()
+
+	subscriber := station.join(t, "lobby", "sub")
+	defer subscriber.Close()
+	publish(t, subscriber, &Signal{Type: base.SIGNALTYPE_CMD, Text: base.CLIENTCMD_SUBSCRIBE + ":room.>"})
+	waitFor(t, "subscription", func() bool {
+		return len(station.SubscribedPatterns()) == 1
+	})
+	if err := station.ApplyModeration(&base.Moderation{Action: base.MODERATION_BAN, CID: "room.a", ID: "sub"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, cid := range []string{"room.a", "room.b"} {
+		ws := station.join(t, cid, "publisher")
+		publish(t, ws, &Signal{Type: base.SIGNALTYPE_SIGNAL, Text: cid})
+		ws.Close()
+	}
+	signal := receiveUntil(t, subscriber, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_SIGNAL
+	})
+	if signal.Text != "room.b" {
+		t.Fatal("banned subscriber received:", signal.Text)
+	}
+}
+
+// TestPatternSubscribeIsChecked subscribes to patterns wider than the grants of the client, and after it is banned,
+// both are rejected.
+func TestPatternSubscribeIsChecked(t *testing.T) {
+	station := newTestStation(t, "s1", nil)
+	defer station.Close()
+	authenticator := &HMACAuthenticator{Secret: []byte("secret")}
+	station.Authenticator = authenticator
+
+	token := authenticator.NewToken("lobby", "p", "pubsub@lobby;sub@room.a.>", time.Now().Add(time.Hour))
+	ws := station.dial(t, url.Values{"cid": {"lobby"}, "token": {token}})
+	defer ws.Close()
+	receiveUntil(t, ws, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_PJOIN
+	})
+	publish(t, ws, &Signal{Type: base.SIGNALTYPE_CMD, Text: base.CLIENTCMD_SUBSCRIBE + ":room.>"})
+	receiveUntil(t, ws, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_ERROR && signal.Text == "no permission on channel"
+	})
+	if err := station.ApplyModeration(&base.Moderation{Action: base.MODERATION_BAN, ID: "p"}); err != nil {
+		t.Fatal(err)
+	}
+	publish(t, ws, &Signal{Type: base.SIGNALTYPE_CMD, Text: base.CLIENTCMD_SUBSCRIBE + ":room.a.>"})
+	receiveUntil(t, ws, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_ERROR && signal.Text == base.ERROR_BANNED
+	})
+	if patterns := station.SubscribedPatterns(); len(patterns) != 0 {
+		t.Fatal("subscribed:", patterns)
+	}
+}
+
+// TestPatternSubscriberReceivesRemoteChannels subscribes to a pattern on one station,
+// the signals of a matching channel hosted by the other station reach the subscriber.
+func TestPatternSubscriberReceivesRemoteChannels(t *testing.T) {
+	a := newTestStation(t, "a", nil)
+	defer a.Close()
+	b := newTestStation(t, "b", nil)
+	defer b.Close()
+	go b.RelayWithStation(a.addr)
+	waitFor(t, "relay to join", func() bool {
+		return a.RelayCount() == 1 && b.RelayCount() == 1
+	})
+
+	subscriber := b.join(t, "lobby", "sub")
+	defer subscriber.Close()
+	publish(t, subscriber, &Signal{Type: base.SIGNALTYPE_CMD, Text: base.CLIENTCMD_SUBSCRIBE + ":room.*"})
+	waitFor(t, "subscription", func() bool {
+		return len(b.SubscribedPatterns()) == 1
+	})
+	publisher := a.join(t, "room.x", "publisher")
+	defer publisher.Close()
+	publish(t, publisher, &Signal{Type: base.SIGNALTYPE_SIGNAL, Text: "hi"})
+	signal := receiveUntil(t, subscriber, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_SIGNAL
+	})
+	if signal.CID != "room.x" || signal.Text != "hi" {
+		t.Fatal("subscriber received:", signal.CID, signal.Text)
+	}
+}
+
+// TestMutedClientCanNotSetState mutes a client in the channel, its state changes are rejected
+// and the other members receive the changes of unmuted clients only.
+func TestMutedClientCanNotSetState(t *testing.T) {
+	station := newTestStation(t, "s1", nil)
+	defer station.Close()
+
+	muted := station.join(t, "room", "muted")
+	defer muted.Close()
+	member := station.join(t, "room", "member")
+	defer member.Close()
+	if err := station.ApplyModeration(&base.Moderation{Action: base.MODERATION_MUTE, CID: "room", ID: "muted"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{base.CLIENTCMD_SET + ":room:k=v", base.CLIENTCMD_DELETE + ":room:k"} {
+		publish(t, muted, &Signal{Type: base.SIGNALTYPE_CMD, Text: cmd})
+		receiveUntil(t, muted, func(signal *Signal) bool {
+			return signal.Type == base.SIGNALTYPE_ERROR && signal.Text == base.ERROR_MUTED
+		})
+	}
+	publish(t, member, &Signal{Type: base.SIGNALTYPE_CMD, Text: base.CLIENTCMD_SET + ":room:other=v"})
+	signal := receiveUntil(t, member, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_STATE
+	})
+	if !strings.Contains(signal.Text, `"other"`) {
+		t.Fatal("state of muted client received:", signal.Text)
+	}
+}
+
+// TestKickedSubscriberReceivesNothing kicks a client subscribed to a pattern from one of the matching channels,
+// the pattern is unsubscribed so the client receives nothing of the channel.
+func TestKickedSubscriberReceivesNothing(t *testing.T) {
+	station := newTestStation(t, "s1", nil)
+	defer station.Close()
+
+	subscriber := station.join(t, "lobby", "sub")
+	defer subscriber.Close()
+	publish(t, subscriber, &Signal{Type: base.SIGNALTYPE_CMD, Text: base.CLIENTCMD_SUBSCRIBE + ":room.>"})
+	waitFor(t, "subscription", func() bool {
+		return len(station.SubscribedPatterns()) == 1
+	})
+	if err := station.ApplyModeration(&base.Moderation{Action: base.MODERATION_KICK, CID: "room.a", ID: "sub"}); err != nil {
+		t.Fatal(err)
+	}
+	receiveUntil(t, subscriber, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_ERROR && signal.Text == base.ERROR_KICKED
+	})
+	ws := station.join(t, "room.a", "publisher")
+	publish(t, ws, &Signal{Type: base.SIGNALTYPE_SIGNAL, Text: "room.a"})
+	ws.Close()
+	lobby := station.join(t, "lobby", "publisher")
+	defer lobby.Close()
+	publish(t, lobby, &Signal{Type: base.SIGNALTYPE_SIGNAL, Text: "lobby"})
+	signal := receiveUntil(t, subscriber, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_SIGNAL
+	})
+	if signal.Text != "lobby" {
+		t.Fatal("kicked subscriber received:", signal.Text)
+	}
+}
+
+// TestResumeReplaysMoreThanTheQueue resumes a client from the start of a history much longer than its queue,
+// every replayed signal is received in order.
+func TestResumeReplaysMoreThanTheQueue(t *testing.T) {
+	station := newTestStation(t, "s1", func(station *Station) {
+		station.ClientQueue = base.QueuePolicy{Size: 10}
+	})
+	defer station.Close()
+
+	keeper := station.join(t, "room", "keeper")
+	defer keeper.Close()
+	for n := 0; n < 500; n++ {
+		station.Broadcast(&SignalPack{
+			Signal:   Signal{ID: strconv.Itoa(n), Type: base.SIGNALTYPE_SIGNAL, Text: strconv.Itoa(n)},
+			CID:      "room",
+			Time:     time.Now(),
+			Stations: []string{"remote"},
+		})
+	}
+
+	seqSID := receiveUntil(t, keeper, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_SIGNAL
+	}).SeqSID
+
+	ws := station.dial(t, url.Values{"cid": {"room"}, "token": {"p"}, "lastseq": {"0"}, "lastsid": {seqSID}})
+	defer ws.Close()
+	var seq uint64
+	receiveUntil(t, ws, func(signal *Signal) bool {
+		if signal.Type == base.SIGNALTYPE_ERROR {
+			t.Fatal("resume error:", signal.Text)
+		}
+		if signal.Seq != seq+1 || signal.SeqSID != seqSID {
+			t.Fatal("replayed", signal.SeqSID, signal.Seq, "after", seq)
+		}
+		seq = signal.Seq
+		return signal.Type == base.SIGNALTYPE_SIGNAL && signal.Text == "499"
+	})
+}
+
+// TestMaxChannelSizeUnderConcurrentResumes resumes more clients than the room left in the channel at once,
+// every client is replayed a long history, only those admitted join in the channel.
+func TestMaxChannelSizeUnderConcurrentResumes(t *testing.T) {
+	station := newTestStation(t, "s1", func(station *Station) {
+		station.ClientQueue = base.QueuePolicy{Size: 10}
+		station.MaxChannelSize = 3
+	})
+	defer station.Close()
+
+	keeper := station.join(t, "room", "keeper")
+	defer keeper.Close()
+	for n := 0; n < 500; n++ {
+		station.Broadcast(&SignalPack{
+			Signal:   Signal{ID: strconv.Itoa(n), Type: base.SIGNALTYPE_SIGNAL, Text: "x"},
+			CID:      "room",
+			Time:     time.Now(),
+			Stations: []string{"remote"},
+		})
+	}
+	seqSID := receiveUntil(t, keeper, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_SIGNAL
+	}).SeqSID
+
+	clients := sync.WaitGroup{}
+	conns := make(chan *websocket.Conn, 10)
+	for i := 0; i < 10; i++ {
+		clients.Add(1)
+		go func(pid string) {
+			defer clients.Done()
+			ws, err := station.dialClient(url.Values{"cid": {"room"}, "token": {pid}, "lastseq": {"0"}, "lastsid": {seqSID}})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conns <- ws
+			_, err = receiveSignal(ws, func(signal *Signal) bool {
+				return signal.Type == base.SIGNALTYPE_ERROR || signal.Type == base.SIGNALTYPE_PJOIN && strings.HasPrefix(signal.PID, pid+"_")
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}("p" + strconv.Itoa(i))
+	}
+	clients.Wait()
+	close(conns)
+	for ws := range conns {
+		defer ws.Close()
+	}
+	if size := station.ChannelClientCount("room"); size != 3 {
+		t.Fatal("clients in the channel:", size)
+	}
+}
+
+// TestResumeRejectsSeqOfOtherStation resumes a client by a sequence numbered by another station, it receives a gap error.
+func TestResumeRejectsSeqOfOtherStation(t *testing.T) {
+	station := newTestStation(t, "s1", nil)
+	defer station.Close()
+
+	keeper := station.join(t, "room", "keeper")
+	defer keeper.Close()
+	ws := station.dial(t, url.Values{"cid": {"room"}, "token": {"p"}, "lastseq": {"0"}, "lastsid": {"s2"}})
+	defer ws.Close()
+	signal := receiveUntil(t, ws, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_ERROR || signal.Type == base.SIGNALTYPE_PJOIN
+	})
+	if signal.Type != base.SIGNALTYPE_ERROR || signal.Text != base.ERROR_GAP {
+		t.Fatal("resumed by the sequence of another station")
+	}
+}
+
+// TestResumeRejectsSeqOfRestartedStation resumes a client by a sequence of a station that restarted with the same sid,
+// the history numbers the signals from the start again, so the client receives a gap error instead of the new signals.
+func TestResumeRejectsSeqOfRestartedStation(t *testing.T) {
+	broadcast := func(station *testStation, count int) {
+		for n := 0; n < count; n++ {
+			station.Broadcast(&SignalPack{
+				Signal:   Signal{ID: uuid.New(), Type: base.SIGNALTYPE_SIGNAL, Text: strconv.Itoa(n)},
+				CID:      "room",
+				Time:     time.Now(),
+				Stations: []string{"remote"},
+			})
+		}
+	}
+	station := newTestStation(t, "s1", nil)
+	keeper := station.join(t, "room", "keeper")
+	broadcast(station, 30)
+	last := receiveUntil(t, keeper, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_SIGNAL && signal.Text == "29"
+	})
+	keeper.Close()
+	station.Close()
+
+	restarted := newTestStation(t, "s1", nil)
+	defer restarted.Close()
+	keeper = restarted.join(t, "room", "keeper")
+	defer keeper.Close()
+	broadcast(restarted, 50)
+
+	ws := restarted.dial(t, url.Values{"cid": {"room"}, "token": {"p"}, "lastseq": {strconv.FormatUint(last.Seq, 10)}, "lastsid": {last.SeqSID}})
+	defer ws.Close()
+	signal := receiveUntil(t, ws, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_ERROR || signal.Type == base.SIGNALTYPE_SIGNAL
+	})
+	if signal.Type != base.SIGNALTYPE_ERROR || signal.Text != base.ERROR_GAP {
+		t.Fatal("resumed by the sequence of the station before restarting:", signal.Seq, signal.Text)
+	}
+}
+
+// TestCommandsAreRateLimited sends commands faster than the client limit, they are rejected with the limit error.
+func TestCommandsAreRateLimited(t *testing.T) {
+	station := newTestStation(t, "s1", func(station *Station) {
+		station.ClientLimit = base.RateLimit{Signals: 5}
+	})
+	defer station.Close()
+
+	ws := station.join(t, "room", "p")
+	defer ws.Close()
+	for n := 0; n < 20; n++ {
+		publish(t, ws, &Signal{Type: base.SIGNALTYPE_CMD, Text: base.CLIENTCMD_ACK + ":" + strconv.Itoa(n)})
+	}
+	receiveUntil(t, ws, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_ERROR && signal.Text == base.ERROR_CLIENTLIMIT
+	})
+}
+
+// TestFrameSizeIsCheckedByHeader sends the header of a frame larger than the max frame size without its payload,
+// the client is disconnected without the station waiting for the payload.
+func TestFrameSizeIsCheckedByHeader(t *testing.T) {
+	station := newTestStation(t, "s1", func(station *Station) {
+		station.MaxFrameSize = 1024
+	})
+	defer station.Close()
+
+	config, err := websocket.NewConfig("ws://"+station.addr+base.STATION_CLIENT_JOIN_PATH+"?cid=room&token=p", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", station.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := websocket.NewClient(config, conn); err != nil {
+		t.Fatal(err)
+	}
+	// a masked text frame of 1MB, the payload never follows
+	header := []byte{0x81, 0x80 | 127, 0, 0, 0, 0, 0, 0x10, 0, 0, 1, 2, 3, 4}
+	if _, err := conn.Write(header); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatal("not disconnected:", err)
+	}
+	if station.Violations().Frame != 1 {
+		t.Fatal("frame violations:", station.Violations().Frame)
+	}
+}
+
+// TestInterceptedCopyKeepsID replaces the published signal by a modified copy and forks another copy,
+// the replacing copy keeps the id of the published signal and the fork has a new one.
+func TestInterceptedCopyKeepsID(t *testing.T) {
+	station := newTestStation(t, "s1", func(station *Station) {
+		station.AddInterceptor(InterceptorFunc(func(station *Station, signal *SignalPack) ([]*SignalPack, error) {
+			modified, forked := *signal, *signal
+			modified.Signal.Text = "modified"
+			forked.Signal.Text = "forked"
+			return []*SignalPack{&modified, &forked}, nil
+		}))
+	})
+	defer station.Close()
+
+	ws := station.dial(t, url.Values{"cid": {"room"}, "token": {"p"}, "reliable": {"1"}})
+	defer ws.Close()
+	receiveUntil(t, ws, func(signal *Signal) bool {
+		return signal.Type == base.SIGNALTYPE_PJOIN
+	})
+	publish(t, ws, &Signal{ID: "m1", Type: base.SIGNALTYPE_SIGNAL, Text: "original"})
+	ids := map[string]string{}
+	receiveUntil(t, ws, func(signal *Signal) bool {
+		if signal.Type == base.SIGNALTYPE_SIGNAL {
+			ids[signal.Text] = signal.ID
+		}
+		return len(ids) == 2
+	})
+	if ids["modified"] != "p-m1" || ids["forked"] == "p-m1" {
+		t.Fatal("ids of the intercepted signals:", ids)
+	}
+}
+
+// slowAuthenticator accepts every client after a while, so that clients joining at once are all authenticated at once.
+type slowAuthenticator struct {
+	AnonymousAuthenticator
+}
+
+func (this *slowAuthenticator) Authenticate(cid string, token string, request *http.Request) (*Identity, error) {
+	time.Sleep(50 * time.Millisecond)
+	return this.AnonymousAuthenticator.Authenticate(cid, token, request)
+}
+
+// TestMaxClientsUnderConcurrentJoins joins more clients than MaxClients at once, only MaxClients of them are accepted.
+func TestMaxClientsUnderConcurrentJoins(t *testing.T) {
+	station := newTestStation(t, "s1", func(station *Station) {
+		station.MaxClients = 5
+	})
+	defer station.Close()
+	station.Authenticator = &slowAuthenticator{}
+
+	var joined int64
+	clients := sync.WaitGroup{}
+	conns := make(chan *websocket.Conn, 30)
+	for i := 0; i < 30; i++ {
+		clients.Add(1)
+		go func(pid string) {
+			defer clients.Done()
+			ws, err := station.dialClient(url.Values{"cid": {"room"}, "token": {pid}})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conns <- ws
+			signal, err := receiveSignal(ws, func(signal *Signal) bool {
+				return signal.Type == base.SIGNALTYPE_ERROR || signal.Type == base.SIGNALTYPE_PJOIN && strings.HasPrefix(signal.PID, pid+"_")
+			})
+			if err != nil {
+				t.Error(err)
+			} else if signal.Type == base.SIGNALTYPE_PJOIN {
+				atomic.AddInt64(&joined, 1)
+			} else if signal.Text != base.ERROR_STATIONFULL {
+				t.Error("rejected by:", signal.Text)
+			}
+		}("p" + strconv.Itoa(i))
+	}
+	clients.Wait()
+	close(conns)
+	for ws := range conns {
+		ws.Close()
+	}
+	if joined != 5 {
+		t.Fatal("clients joined:", joined)
+	}
+}
+
+// TestDrainRedirectsAfterSignals drains the station while signals are broadcasted, the redirect follows all of them,
+// and the client can not publish after it.
+func TestDrainRedirectsAfterSignals(t *testing.T) {
+	station := newTestStation(t, "s1", nil)
+	defer station.Close()
+
+	ws := station.join(t, "room", "p")
+	defer ws.Close()
+	for n := 0; n < 100; n++ {
+		station.Broadcast(&SignalPack{
+			Signal:   Signal{ID: "r" + strconv.Itoa(n), Type: base.SIGNALTYPE_SIGNAL, Text: strconv.Itoa(n)},
+			CID:      "room",
+			Time:     time.Now(),
+			Stations: []string{"remote"},
+		})
+	}
+	drained := make(chan bool)
+	go func() {
+		station.Drain(time.Second)
+		close(drained)
+	}()
+	received := 0
+	receiveUntil(t, ws, func(signal *Signal) bool {
+		if signal.Type == base.SIGNALTYPE_SIGNAL {
+			received++
+		}
+		return signal.Type == base.SIGNALTYPE_REDIRECT
+	})
+	if received != 100 {
+		t.Fatal("signals received before the redirect:", received)
+	}
+	publish(t, ws, &Signal{Type: base.SIGNALTYPE_SIGNAL, Text: "late"})
+	receiveUntil(t, ws, func(signal *Signal) bool {
+		if signal.Type == base.SIGNALTYPE_SIGNAL {
+			t.Fatal("published while draining")
+		}
+		return signal.Type == base.SIGNALTYPE_ERROR && signal.Text == base.ERROR_SHUTTINGDOWN
+	})
+	<-drained
+}
+
+// TestRelayCodecIsNegotiated relays a signal with a payload to remote stations, in a binary frame to the station that supports it,
+// and in a JSON text frame to the station of an older version.
+func TestRelayCodecIsNegotiated(t *testing.T) {
+	station := newTestStation(t, "s1", nil)
+	defer station.Close()
+	station.Info.Binary = true
+
+	sender := station.join(t, "room", "sender")
+	defer sender.Close()
+	for port, binary := range map[int]bool{1: true, 2: false} {
+		ws, err := websocket.Dial("ws://"+station.addr+base.STATION_RELAY_JOIN_PATH, "", "http://localhost/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := base.SwitchServerInfo(ws, &base.ServerInfo{SID: "remote", IP: "127.0.0.1", Port: port, Binary: binary}); err != nil {
+			t.Fatal(err)
+		}
+		text := "binary-" + strconv.FormatBool(binary)
+		publish(t, sender, &Signal{Type: base.SIGNALTYPE_SIGNAL, Text: text, Payload: []byte{0, 1, 2}})
+
+		var payloadType byte
+		codec := websocket.Codec{Unmarshal: func(data []byte, frameType byte, v interface{}) error {
+			payloadType = frameType
+			return unmarshalFrame(data, frameType, v)
+		}}
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var signal SignalPack
+			if err := codec.Receive(ws, &signal); err != nil {
+				t.Fatal("no relayed signal:", err)
+			}
+			if signal.Signal.Text == text {
+				if string(signal.Signal.Payload) != string([]byte{0, 1, 2}) {
+					t.Fatal("bad payload:", signal.Signal.Payload)
+				}
+				break
+			}
+		}
+		if binary && payloadType != websocket.BinaryFrame || !binary && payloadType != websocket.TextFrame {
+			t.Fatal("relayed in frame type", payloadType, "to the remote station supporting binary:", binary)
+		}
+		ws.Close()
+	}
+}
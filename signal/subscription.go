@@ -0,0 +1,74 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"saassoft.net/signaldistribution/base"
+	"sync"
+)
+
+// Subscriptions is the index of the channel patterns that the clients of a station subscribed to.
+// A pattern is formed as base.MatchChannel accepts, e.g. "site1.*" or "site1.>".
+type Subscriptions struct {
+	patterns map[string]map[string]*Client
+	locker   sync.RWMutex
+}
+
+// Init sets up the subscriptions.
+func (this *Subscriptions) Init() {
+	this.patterns = make(map[string]map[string]*Client)
+}
+
+// Subscribe adds the client to the subscribers of the pattern.
+func (this *Subscriptions) Subscribe(pattern string, client *Client) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	if this.patterns[pattern] == nil {
+		this.patterns[pattern] = make(map[string]*Client)
+	}
+	this.patterns[pattern][client.Info.UPID] = client
+}
+
+// Unsubscribe removes the client from the subscribers of the pattern.
+func (this *Subscriptions) Unsubscribe(pattern string, client *Client) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	if this.patterns[pattern] == nil {
+		return
+	}
+	delete(this.patterns[pattern], client.Info.UPID)
+	if len(this.patterns[pattern]) == 0 {
+		delete(this.patterns, pattern)
+	}
+}
+
+// Match returns the clients those subscribed to a pattern matching the cid, each client is returned once.
+func (this *Subscriptions) Match(cid string) []*Client {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+	clients := []*Client{}
+	matched := make(map[string]bool)
+	for pattern, subscribers := range this.patterns {
+		if !base.MatchChannel(pattern, cid) {
+			continue
+		}
+		for upid, client := range subscribers {
+			if !matched[upid] {
+				matched[upid] = true
+				clients = append(clients, client)
+			}
+		}
+	}
+	return clients
+}
+
+// Patterns returns the patterns those have subscribers.
+func (this *Subscriptions) Patterns() []string {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+	patterns := []string{}
+	for pattern, _ := range this.patterns {
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
@@ -0,0 +1,114 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"saassoft.net/signaldistribution/base"
+	"time"
+)
+
+// Webhook notifies the events of the station to an http url by POST requests with the json of base.Event.
+// The body is signed with Secret by HMAC-SHA256 in the base.WEBHOOK_SIGNATURE header.
+// Events are delivered in order by a goroutine, a failed request is retried with backoff,
+// the events are dropped when the queue is full.
+// Events are the event types notified, empty means all.
+type Webhook struct {
+	URL    string
+	Secret []byte
+	Events []string
+	events chan *base.Event
+	client *http.Client
+	retry  time.Duration
+}
+
+// NewWebhook returns a webhook to the url, it starts delivering events at once.
+func NewWebhook(url string, secret []byte, events []string) *Webhook {
+	webhook := &Webhook{
+		URL:    url,
+		Secret: secret,
+		Events: events,
+		events: make(chan *base.Event, base.DEFAULT_QUEUE_SIZE),
+		client: &http.Client{Timeout: base.WEBHOOK_TIMEOUT},
+		retry:  base.WEBHOOK_RETRY_INTERVAL,
+	}
+	go webhook.run()
+	return webhook
+}
+
+// Notify queues the event if the webhook accepts its type.
+func (this *Webhook) Notify(event *base.Event) {
+	if len(this.Events) > 0 && !base.StringInArray(event.Type, this.Events) {
+		return
+	}
+	select {
+	case this.events <- event:
+	default:
+		log.Println("station - webhook: queue is full, event dropped:", event.Type, event.ID)
+	}
+}
+
+// Sign returns the signature of the body.
+func (this *Webhook) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, this.Secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (this *Webhook) run() {
+	for event := range this.events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		interval := this.retry
+		for retries := 0; ; retries++ {
+			if err = this.post(event.Type, body); err == nil {
+				break
+			}
+			if retries == base.WEBHOOK_MAX_RETRIES {
+				log.Println("station - webhook: event dropped:", event.Type, event.ID, err)
+				break
+			}
+			time.Sleep(interval)
+			interval *= 2
+		}
+	}
+}
+
+func (this *Webhook) post(eventType string, body []byte) error {
+	request, err := http.NewRequest("POST", this.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(base.WEBHOOK_EVENT, eventType)
+	request.Header.Set(base.WEBHOOK_SIGNATURE, this.Sign(body))
+	response, err := this.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return errors.New("webhook: " + response.Status)
+	}
+	return nil
+}
+
+// fireEvent notifies the event to the webhooks of the station.
+func (this *Station) fireEvent(eventType string, id string, pid string) {
+	if len(this.Webhooks) == 0 {
+		return
+	}
+	event := &base.Event{Type: eventType, SID: this.Info.SID, ID: id, PID: pid, Time: time.Now()}
+	for _, webhook := range this.Webhooks {
+		webhook.Notify(event)
+	}
+}
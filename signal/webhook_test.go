@@ -0,0 +1,129 @@
+// Copyright 2014 liveease.com. All rights reserved.
+
+package signal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"saassoft.net/signaldistribution/base"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRequest is a request received by the test webhook server.
+type webhookRequest struct {
+	event     string
+	signature string
+	body      []byte
+	time      time.Time
+}
+
+// newWebhookServer returns a server that fails the first failures requests, the requests are sent to the channel.
+func newWebhookServer(failures int, requests chan *webhookRequest) *httptest.Server {
+	var lock sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		requests <- &webhookRequest{
+			event:     req.Header.Get(base.WEBHOOK_EVENT),
+			signature: req.Header.Get(base.WEBHOOK_SIGNATURE),
+			body:      body,
+			time:      time.Now(),
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+}
+
+func receiveRequest(t *testing.T, requests chan *webhookRequest) *webhookRequest {
+	select {
+	case request := <-requests:
+		return request
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook request")
+	}
+	return nil
+}
+
+// TestWebhookSignsAndRetries fails the first requests, the event is retried with a doubling interval,
+// and every request is signed with the secret.
+func TestWebhookSignsAndRetries(t *testing.T) {
+	requests := make(chan *webhookRequest, 10)
+	server := newWebhookServer(2, requests)
+	defer server.Close()
+
+	webhook := NewWebhook(server.URL, []byte("secret"), nil)
+	// set before the first event, which is received by the delivering goroutine
+	webhook.retry = 50 * time.Millisecond
+	webhook.Notify(&base.Event{Type: base.EVENT_CLIENTJOIN, SID: "s1", ID: "p_1", PID: "p"})
+
+	attempts := []*webhookRequest{}
+	for len(attempts) < 3 {
+		attempts = append(attempts, receiveRequest(t, requests))
+	}
+	for _, request := range attempts {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(request.body)
+		if request.signature != hex.EncodeToString(mac.Sum(nil)) {
+			t.Fatal("bad signature:", request.signature)
+		}
+		if request.event != base.EVENT_CLIENTJOIN {
+			t.Fatal("bad event header:", request.event)
+		}
+		if string(request.body) != string(attempts[0].body) {
+			t.Fatal("retried with another body:", string(request.body))
+		}
+	}
+	var event base.Event
+	if err := json.Unmarshal(attempts[0].body, &event); err != nil || event.ID != "p_1" || event.PID != "p" || event.SID != "s1" {
+		t.Fatal("bad event:", string(attempts[0].body), err)
+	}
+	first, second := attempts[1].time.Sub(attempts[0].time), attempts[2].time.Sub(attempts[1].time)
+	if first < 50*time.Millisecond || second < 100*time.Millisecond {
+		t.Fatal("retried without backoff:", first, second)
+	}
+	select {
+	case request := <-requests:
+		t.Fatal("delivered again after success:", request.event)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// TestWebhookNotifiesEvents joins and quits a client, the webhook is notified of the event types it accepts only, in order.
+func TestWebhookNotifiesEvents(t *testing.T) {
+	requests := make(chan *webhookRequest, 10)
+	server := newWebhookServer(0, requests)
+	defer server.Close()
+
+	station := newTestStation(t, "s1", func(station *Station) {
+		station.Webhooks = []*Webhook{NewWebhook(server.URL, []byte("secret"), []string{base.EVENT_CLIENTJOIN, base.EVENT_CLIENTQUIT})}
+	})
+	defer station.Close()
+
+	ws := station.join(t, "room", "p")
+	ws.Close()
+	for _, expected := range []string{base.EVENT_CLIENTJOIN, base.EVENT_CLIENTQUIT} {
+		request := receiveRequest(t, requests)
+		var event base.Event
+		if err := json.Unmarshal(request.body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if request.event != expected || event.Type != expected || event.PID != "p" || event.SID != "s1" {
+			t.Fatal("unexpected event:", request.event, string(request.body))
+		}
+	}
+	select {
+	case request := <-requests:
+		t.Fatal("event not accepted by the webhook is notified:", request.event)
+	case <-time.After(200 * time.Millisecond):
+	}
+}